@@ -15,6 +15,8 @@ type baseHandler struct {
 	pattern   string
 	requestID string
 	data      []byte
+	// release, if set, returns pooled resources once the request is processed
+	release func()
 }
 
 // Log ensures that the requestID is always applied to the logs
@@ -40,8 +42,19 @@ func (b *baseHandler) Process(w http.ResponseWriter, req *http.Request) {
 	b.Info(fmt.Sprintf("Processing %v", b.pattern))
 	defer b.Info(fmt.Sprintf("Completed %v", b.pattern))
 
+	// Pooled resources are returned however processing ends
+	defer func() {
+		if b.release != nil {
+			b.release()
+		}
+	}()
+
 	defer func() {
 		if r := recover(); r != nil {
+			// Responses already under way are aborted by the server
+			if r == http.ErrAbortHandler {
+				panic(r)
+			}
 			b.Error(fmt.Sprintf("Processing error %v", r))
 			returnError(w, "Request error", http.StatusBadRequest)
 		}
@@ -65,7 +78,20 @@ func (b *baseHandler) Process(w http.ResponseWriter, req *http.Request) {
 }
 
 // authorize provides a standard access point to validate
-// requestor credentials
+// requestor credentials.  When tenants are defined, the handler
+// then uses the cache of the requestor's tenant.
 func (b *baseHandler) authorize(req *http.Request) error {
+	if b.config.tenants == nil {
+		return nil
+	}
+
+	config, err := b.config.tenants.resolve(req)
+	if err != nil {
+		b.Warn("Authorization failed - %v", err)
+		return err
+	}
+
+	b.config = config
+	b.Debug("Authorized tenant %v", config.tenant)
 	return nil
 }
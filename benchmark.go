@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// benchmarkCodecs reports the compression ratio and throughput of each codec,
+// over pages built from the CSV file in the same way as an ingest would
+func benchmarkCodecs(out io.Writer, fileName string, recordsPerPage, level int) error {
+	if recordsPerPage <= 0 {
+		return fmt.Errorf("records per page must be positive")
+	}
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return fmt.Errorf("%v contains no records", fileName)
+	}
+
+	cols := []Column{}
+	for i := range records[0] {
+		cols = append(cols, Column{Name: fmt.Sprintf("col%v", i), Type: "string"})
+	}
+
+	m := &writeHandler{}
+	pages := [][]byte{}
+	var raw int64
+	for start := 0; start < len(records); start += recordsPerPage {
+		end := start + recordsPerPage
+		if end > len(records) {
+			end = len(records)
+		}
+		page := m.createPageBytes(NewUUID(), cols, records[start:end])
+		pages = append(pages, page)
+		raw += int64(len(page))
+	}
+
+	fmt.Fprintf(out, "%v pages, %v bytes, %v records per page, level %v\n\n", len(pages), raw, recordsPerPage, level)
+
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "codec\tbytes\tratio\tcompress MB/s\tdecompress MB/s\t")
+	for _, name := range codecNames() {
+		c, _ := codecByName(name)
+
+		compressed := make([][]byte, len(pages))
+		var size int64
+		start := time.Now()
+		for i, page := range pages {
+			var buf bytes.Buffer
+			zw, err := c.newWriter(&buf, level)
+			if err != nil {
+				return err
+			}
+			zw.Write(page)
+			if err := zw.Close(); err != nil {
+				return err
+			}
+			compressed[i] = buf.Bytes()
+			size += int64(buf.Len())
+		}
+		compressTime := time.Since(start)
+
+		start = time.Now()
+		for _, page := range compressed {
+			zr, err := c.newReader(bytes.NewReader(page))
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(io.Discard, zr)
+			zr.Close()
+			if err != nil {
+				return err
+			}
+		}
+		decompressTime := time.Since(start)
+
+		fmt.Fprintf(tw, "%v\t%v\t%.2f\t%.1f\t%.1f\t\n", name, size,
+			float64(raw)/float64(size), throughput(raw, compressTime), throughput(raw, decompressTime))
+	}
+	return tw.Flush()
+}
+
+// throughput returns the MB/s of processing n bytes in the duration
+func throughput(n int64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(n) / (1 << 20) / d.Seconds()
+}
+
+// benchmarkServing reports the memory used to serve pages, when read into memory
+// and when streamed from their files, for plain pages and pages stored with each
+// codec.  The pages are served by an in-process server to concurrent clients.
+func benchmarkServing(out io.Writer, recordsPerPage, pages, clients int) error {
+	if recordsPerPage <= 0 || pages <= 0 || clients <= 0 {
+		return fmt.Errorf("records per page, pages and clients must be positive")
+	}
+
+	root, err := os.MkdirTemp("", "dataproxy-bench")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(root)
+
+	cols := []Column{{Name: "id", Type: "string"}, {Name: "name", Type: "string"}, {Name: "value", Type: "string"}}
+	records := make([][]string, recordsPerPage)
+	for i := range records {
+		records[i] = []string{fmt.Sprintf("%08d", i), fmt.Sprintf("name-%v", i*7919%100003), fmt.Sprintf("%v.%02d", i*31, i%100)}
+	}
+
+	fmt.Fprintf(out, "%v pages of %v records, %v clients\n\n", pages, recordsPerPage, clients)
+
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "codec\tserving\tpage bytes\talloc/page\tpeak heap\tMB/s\t")
+	for _, name := range append([]string{"none"}, codecNames()...) {
+		config, err := newCacheConfig(&cacheOptions{
+			storeKind:   "file",
+			store:       storeOptions{root: fmt.Sprintf("%v/%v", root, name)},
+			codec:       name,
+			evictPolicy: evictLRU,
+			gcInterval:  time.Hour,
+		})
+		if err != nil {
+			return err
+		}
+
+		hash := NewUUID()
+		tokens := make([]string, pages)
+		for i := range tokens {
+			tokens[i] = NewUUID()
+		}
+
+		m := &writeHandler{baseHandler: baseHandler{config: config, requestID: "benchmark"}}
+		if err := m.createDataset(&datasetInfo{Hash: hash, Tokens: tokens}, 0, 0); err != nil {
+			return err
+		}
+		for i, token := range tokens {
+			next := ""
+			if i+1 < len(tokens) {
+				next = tokens[i+1]
+			}
+			if err := m.createPage(context.Background(), hash, token, next, cols, records); err != nil {
+				return err
+			}
+		}
+		m.completeDataset(hash, nil, int64(pages*len(records)))
+
+		for _, stream := range []bool{false, true} {
+			config.streamPages = stream
+			result, err := benchmarkRequests(config, hash, tokens, clients)
+			if err != nil {
+				return err
+			}
+
+			serving := "buffered"
+			if stream {
+				serving = "streamed"
+			}
+			fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%.1f\t\n", name, serving, result.bytes/int64(len(tokens)),
+				result.alloc/uint64(len(tokens)), result.peakHeap, throughput(result.bytes, result.elapsed))
+		}
+
+		config.close()
+	}
+	return tw.Flush()
+}
+
+// servingResult is the outcome of serving a dataset
+type servingResult struct {
+	bytes    int64
+	alloc    uint64
+	peakHeap uint64
+	elapsed  time.Duration
+}
+
+// benchmarkRequests serves each page of the dataset once, shared between the clients
+func benchmarkRequests(config *cacheConfig, hash string, tokens []string, clients int) (*servingResult, error) {
+	server := httptest.NewServer(http.HandlerFunc(requestHandler("/page", config, NewPageRequestHandlerFactory(clients))))
+	defer server.Close()
+
+	// Responses are read as sent, without transparent decompression
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true, MaxIdleConnsPerHost: clients}}
+
+	stop := startHeapSampler()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+
+	var served int64
+	var next int64 = -1
+	var firstErr error
+	var errOnce sync.Once
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				n := atomic.AddInt64(&next, 1)
+				if n >= int64(len(tokens)) {
+					return
+				}
+				body := fmt.Sprintf(`{"hash":%q,"token":%q}`, hash, tokens[n])
+				req, _ := http.NewRequest(http.MethodPost, server.URL+"/page", bytes.NewBufferString(body))
+				req.Header.Set("Content-Type", "application/json")
+				resp, err := client.Do(req)
+				if err == nil {
+					var copied int64
+					copied, err = io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+					atomic.AddInt64(&served, copied)
+					if err == nil && resp.StatusCode != http.StatusOK {
+						err = fmt.Errorf("page request returned %v", resp.Status)
+					}
+				}
+				if err != nil {
+					errOnce.Do(func() { firstErr = err })
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+	peakHeap := stop()
+	client.CloseIdleConnections()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return &servingResult{
+		bytes:    served,
+		alloc:    after.TotalAlloc - before.TotalAlloc,
+		peakHeap: peakHeap,
+		elapsed:  elapsed,
+	}, nil
+}
+
+// benchmarkIngest reports the peak memory and time taken to ingest the CSV file
+// with differing numbers of page writers.  The largest number approximates
+// writing every page concurrently, as the ingest did before writers were bounded.
+func benchmarkIngest(out io.Writer, fileName string, recordsPerPage int, workers []int) error {
+	if recordsPerPage <= 0 {
+		return fmt.Errorf("records per page must be positive")
+	}
+
+	root, err := os.MkdirTemp("", "dataproxy-bench")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(root)
+
+	stat, err := os.Stat(fileName)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "%v bytes, %v records per page\n\n", stat.Size(), recordsPerPage)
+
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "workers\tpages\tpeak heap\tseconds\tMB/s\t")
+	for i, n := range workers {
+		config, err := newCacheConfig(&cacheOptions{
+			storeKind:     "file",
+			store:         storeOptions{root: fmt.Sprintf("%v/%v", root, i)},
+			evictPolicy:   evictLRU,
+			gcInterval:    time.Hour,
+			ingestWorkers: n,
+		})
+		if err != nil {
+			return err
+		}
+
+		file, err := os.Open(fileName)
+		if err != nil {
+			return err
+		}
+
+		h := &existingFileRequestHandler{}
+		h.config = config
+		h.requestID = "benchmark"
+		hash := NewUUID()
+		if err := h.createDataset(&datasetInfo{Hash: hash, Kind: "existing", Source: fileName}, 0, 0); err != nil {
+			return err
+		}
+		h.job = config.jobs.start(hash, "existing")
+
+		cp := newIngestCheckpoint(&ExistingRequest{CSVFileName: fileName, RecordsPerPage: recordsPerPage}, stat)
+		stop := startHeapSampler()
+		start := time.Now()
+		err = h.cacheData(h.job.context(), hash, cp, file)
+		elapsed := time.Since(start)
+		peak := stop()
+		h.job.finish()
+		config.close()
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%.2f\t%.1f\t\n", n, h.job.Status().Pages, peak, elapsed.Seconds(), throughput(stat.Size(), elapsed))
+	}
+	return tw.Flush()
+}
+
+// startHeapSampler samples the heap until the returned function is called, which
+// returns the peak heap in use above that when sampling started
+func startHeapSampler() func() uint64 {
+	runtime.GC()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	var peakHeap uint64
+	stop := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		var stats runtime.MemStats
+		for {
+			runtime.ReadMemStats(&stats)
+			if stats.HeapAlloc > peakHeap {
+				peakHeap = stats.HeapAlloc
+			}
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}()
+
+	return func() uint64 {
+		close(stop)
+		<-sampled
+		if peakHeap > before.HeapAlloc {
+			return peakHeap - before.HeapAlloc
+		}
+		return 0
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltFileName is the name of the database file within the cache root
+const boltFileName = "pages.db"
+
+// boltStore is a PageStore backed by an embedded, single file, transactional
+// key-value database, holding the pages of each dataset in their own bucket
+type boltStore struct {
+	db *bolt.DB
+}
+
+// newBoltStore opens (or creates) the database in the specified root folder
+func newBoltStore(root string) (*boltStore, error) {
+	db, err := bolt.Open(fmt.Sprintf("%v/%v", root, boltFileName), 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+func (b *boltStore) Put(hash, key string, data []byte) error {
+	return b.PutPages(hash, map[string][]byte{key: data})
+}
+
+// PutPages saves all the pages in a single transaction, so that either all
+// or none of them are written
+func (b *boltStore) PutPages(hash string, pages map[string][]byte) error {
+	if err := validateHash(hash); err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(hash))
+		if err != nil {
+			return err
+		}
+		for key, data := range pages {
+			if err := bucket.Put([]byte(key), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *boltStore) Get(hash, key string) ([]byte, error) {
+	if err := validateHash(hash); err != nil {
+		return nil, err
+	}
+	var data []byte
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(hash))
+		if bucket == nil {
+			return errPageNotFound
+		}
+		v := bucket.Get([]byte(key))
+		if v == nil {
+			return errPageNotFound
+		}
+		// Values are only valid for the life of the transaction
+		data = append([]byte{}, v...)
+		return nil
+	})
+	return data, err
+}
+
+func (b *boltStore) Delete(hash, key string) error {
+	if err := validateHash(hash); err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(hash))
+		if bucket == nil {
+			return nil
+		}
+		if err := bucket.Delete([]byte(key)); err != nil {
+			return err
+		}
+		// Remove the bucket once it holds no pages
+		if k, _ := bucket.Cursor().First(); k == nil {
+			return tx.DeleteBucket([]byte(hash))
+		}
+		return nil
+	})
+}
+
+func (b *boltStore) List(hash string) ([]string, error) {
+	if err := validateHash(hash); err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(hash))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+	})
+	return keys, err
+}
+
+// Datasets returns the hashes of all datasets, as a consistent snapshot
+func (b *boltStore) Datasets() ([]string, error) {
+	hashes := []string{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			hashes = append(hashes, string(name))
+			return nil
+		})
+	})
+	return hashes, err
+}
+
+func (b *boltStore) DeleteDataset(hash string) (int64, error) {
+	if err := validateHash(hash); err != nil {
+		return 0, err
+	}
+	var freed int64
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(hash))
+		if bucket == nil {
+			return nil
+		}
+		bucket.ForEach(func(k, v []byte) error {
+			freed += int64(len(v))
+			return nil
+		})
+		return tx.DeleteBucket([]byte(hash))
+	})
+	return freed, err
+}
+
+// Close releases the database
+func (b *boltStore) Close() error {
+	return b.db.Close()
+}
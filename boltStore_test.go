@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestBoltStoreRejectsInvalidHash(t *testing.T) {
+	b, err := newBoltStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("newBoltStore - %v", err)
+	}
+	defer b.Close()
+
+	for _, hash := range []string{"", "../d1", "d1/d2"} {
+		if _, err := b.Get(hash, "key"); err == nil || err == errPageNotFound {
+			t.Errorf("Get(%q) returned %v, expected invalid hash", hash, err)
+		}
+		if _, err := b.List(hash); err == nil {
+			t.Errorf("List(%q) succeeded, expected invalid hash", hash)
+		}
+		if err := b.Delete(hash, "key"); err == nil {
+			t.Errorf("Delete(%q) succeeded, expected invalid hash", hash)
+		}
+		if _, err := b.DeleteDataset(hash); err == nil {
+			t.Errorf("DeleteDataset(%q) succeeded, expected invalid hash", hash)
+		}
+	}
+}
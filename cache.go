@@ -2,15 +2,9 @@ package main
 
 import (
 	"bytes"
-	"crypto/cipher"
-	"crypto/rand"
 	"crypto/sha256"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"os"
-
-	lz4 "github.com/pierrec/lz4"
 )
 
 type pageInfo struct {
@@ -18,49 +12,89 @@ type pageInfo struct {
 	token          string
 	types          []string
 	useCompression bool
+	// codec overrides the configured codec when writing the page
+	codec *codec
+	// encodings are the content-codings the client accepts, in order of preference,
+	// used when useCompression is set
+	encodings []string
+	// refused are the content-codings the client explicitly does not accept
+	refused map[string]bool
+	// encoding is set by retrievePage to the content-coding of the returned page
+	encoding string
 }
 
-// createCacheFileName creates the subfolder for the request if it doesn't exist
-// and returns the name of the file
-func (b *baseHandler) createCacheFileName(info *pageInfo) (string, error) {
-	err := os.MkdirAll(fmt.Sprintf("%v/%v", b.config.root, info.hash), 0744)
-	if err != nil {
-		return "", err
+// acceptedCodec returns the codec of the most preferred content-coding that the
+// client accepts, or nil if none is acceptable.  "*" is taken to mean gzip, or
+// else zstd, unless the client has refused these.
+func (info *pageInfo) acceptedCodec() *codec {
+	for _, e := range info.encodings {
+		if e == "*" {
+			for _, id := range []byte{codecGzip, codecZstd} {
+				if c := codecs[id]; !info.refused[c.encoding] {
+					return c
+				}
+			}
+			continue
+		}
+		if c := codecByEncoding(e); c != nil {
+			return c
+		}
+	}
+	return nil
+}
+
+// accepts returns true if the client accepts the codec as a content-coding
+func (info *pageInfo) accepts(c *codec) bool {
+	if c.encoding == "" {
+		return false
+	}
+	for _, e := range info.encodings {
+		if e == c.encoding || (e == "*" && !info.refused[c.encoding]) {
+			return true
+		}
 	}
-	return b.getCacheFileName(info), nil
+	return false
 }
 
-// getCacheFileName returns a unique filename for a page
-func (b *baseHandler) getCacheFileName(info *pageInfo) string {
-	data := append(b.config.salt, info.hash...)
+// getPageKey returns the key that uniquely identifies a page within its dataset,
+// without revealing the page token to the PageStore
+func (b *baseHandler) getPageKey(info *pageInfo) string {
+	data := make([]byte, 0, len(b.config.salt)+len(info.hash)+len(info.token))
+	data = append(data, b.config.salt...)
+	data = append(data, info.hash...)
 	data = append(data, info.token...)
 	hash := sha256.Sum256(data)
-	return fmt.Sprintf("%v/%v/%x", b.config.root, info.hash, hash[:])
+	return fmt.Sprintf("%x", hash[:])
 }
 
-// compressData applies lz4 compression to the supplied byte slice
-func (b *baseHandler) compressData(data []byte, token string) ([]byte, error) {
-	b.Debug("Page %v: Compressing", token)
-
-	d := []byte{}
-	r := bytes.NewReader(data)
-	buf := bytes.NewBuffer(d)
-	zw := lz4.NewWriter(buf)
+// compressData applies the codec to the supplied byte slice
+func (b *baseHandler) compressData(data []byte, c *codec, token string) ([]byte, error) {
+	b.Debug("Page %v: Compressing with %v", token, c.name)
 
-	_, err := io.Copy(zw, r)
+	buf := bytes.NewBuffer(make([]byte, 0, len(data)/2))
+	zw, err := c.newWriter(buf, b.config.compressionLevel)
 	if err != nil {
-		b.Error("Page %v: LZ4 write error - %v", token, err)
+		b.Error("Page %v: %v writer error - %v", token, c.name, err)
+		return nil, err
+	}
+
+	if _, err = zw.Write(data); err != nil {
+		zw.Close()
+		b.Error("Page %v: %v write error - %v", token, c.name, err)
+		return nil, err
+	}
+	if err = zw.Close(); err != nil {
+		b.Error("Page %v: %v write error - %v", token, c.name, err)
 		return nil, err
 	}
-	zw.Close()
 
-	b.Debug("Page %v: LZ4", token)
+	b.Debug("Page %v: Compressed with %v", token, c.name)
 	return buf.Bytes(), nil
 }
 
 // uncompressData applies decompression to the supplied byte slice
-func (b *baseHandler) uncompressData(compressedData []byte, token string) ([]byte, error) {
-	b.Debug("Page %v: Uncompressing", token)
+func (b *baseHandler) uncompressData(compressedData []byte, c *codec, token string) ([]byte, error) {
+	b.Debug("Page %v: Uncompressing with %v", token, c.name)
 
 	readAll := func(r io.Reader, initialSize int) error {
 		// Reuse b.data if exists and useful size
@@ -85,13 +119,17 @@ func (b *baseHandler) uncompressData(compressedData []byte, token string) ([]byt
 		}
 	}
 
-	r := bytes.NewReader(compressedData)
-	zr := lz4.NewReader(r)
+	zr, err := c.newReader(bytes.NewReader(compressedData))
+	if err != nil {
+		b.Error("Page %v: %v reader error - %v", token, c.name, err)
+		return nil, fmt.Errorf("internal failure handling page (4)")
+	}
+	defer zr.Close()
 
 	// Scaling of 5 as estimate of compression ratio to minimise reallocs
-	err := readAll(zr, 5*len(compressedData))
+	err = readAll(zr, 5*len(compressedData))
 	if err != nil {
-		b.Error("Page %v: Zip read error - %v", token, err)
+		b.Error("Page %v: %v read error - %v", token, c.name, err)
 		return nil, fmt.Errorf("internal failure handling page (4)")
 	}
 
@@ -99,54 +137,95 @@ func (b *baseHandler) uncompressData(compressedData []byte, token string) ([]byt
 	return b.data, nil
 }
 
-// writePage creates an encrypted page from the slice
-func (b *baseHandler) writePage(data []byte, info *pageInfo) error {
+// writePage creates an encrypted page from the slice, returning the bytes stored
+func (b *baseHandler) writePage(data []byte, info *pageInfo) (int64, error) {
 	b.Debug("Page %v: Writing", info.token)
 	defer b.Debug("Page %v: Completed", info.token)
 
-	// Apply compression if specified
-	if b.config.useCompression {
+	key := b.getPageKey(info)
+
+	env := &pageEnvelope{
+		version:     envelopeVersion,
+		contentType: pageContentType,
+	}
+
+	// Apply compression if specified, by the request or else by the configuration
+	c := info.codec
+	if c == nil {
+		c = b.config.codec
+	}
+	if c != nil && c != noCodec {
 		var err error
-		data, err = b.compressData(data, info.token)
+		data, err = b.compressData(data, c, info.token)
 		if err != nil {
-			return err
+			return 0, err
 		}
+		env.codec = c.id
 	}
 
-	// If a key is provided, assume the page is to be encrypted
-	if b.config.cipher != nil {
-		b.Debug("Page %v: Encrypting", info.token)
+	// Datasets have their own data key if a KeyManager is configured, otherwise
+	// if there is an active key, the page is to be encrypted
+	if b.config.dataKeys != nil {
+		b.Debug("Page %v: Encrypting with data key", info.token)
 
-		gcm, err := cipher.NewGCM(b.config.cipher)
+		block, err := b.config.dataKeys.block(info.hash)
 		if err != nil {
-			b.Error("Page %v: Error creating GCM - %v", info.token, err)
-			return fmt.Errorf("internal failure creating page (1)")
+			b.Error("Page %v: Error obtaining data key - %v", info.token, err)
+			return 0, fmt.Errorf("internal failure creating page (3)")
 		}
 
-		nonce := make([]byte, gcm.NonceSize())
-		if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
-			b.Error("Page %v: Error creating Nonce - %v", info.token, err)
-			return fmt.Errorf("internal failure creating page (2)")
+		env.encryption = encryptionDataKey
+		sealed, err := seal(block, data, pageAAD(env, info.hash, key))
+		if err != nil {
+			b.Error("Page %v: Error encrypting - %v", info.token, err)
+			return 0, fmt.Errorf("internal failure creating page (1)")
 		}
 
-		data = gcm.Seal(nonce, nonce, data, nil)
+		data = sealed
+
+		b.Debug("Page %v: Completed encryption", info.token)
+	} else if keyID, block := b.config.keys.activeKey(); block != nil {
+		b.Debug("Page %v: Encrypting with key %v", info.token, keyID)
+
+		env.encryption = encryptionAESGCM
+		env.keyID = keyID
+		sealed, err := seal(block, data, pageAAD(env, info.hash, key))
+		if err != nil {
+			b.Error("Page %v: Error encrypting - %v", info.token, err)
+			return 0, fmt.Errorf("internal failure creating page (1)")
+		}
+
+		data = sealed
 
 		b.Debug("Page %v: Completed encryption", info.token)
 	}
 
-	b.Debug("Page %v: Writing to Disk", info.token)
-	fileName, err := b.createCacheFileName(info)
+	data = env.encode(data)
+
+	b.Debug("Page %v: Writing to store", info.token)
+	err := b.config.store.Put(info.hash, key, data)
+	b.Debug("Page %v: Writing to store completed", info.token)
 	if err != nil {
-		b.Error("Page %v: Error writing to disk - %v", info.token, err)
-		return err
+		b.Error("Page %v: Error writing to store - %v", info.token, err)
+		return 0, err
 	}
-	err = ioutil.WriteFile(fileName, data, 0644)
-	b.Debug("Page %v: Writing to Disk Completed", info.token)
-	if err != nil {
-		b.Error("Page %v: Error writing to disk - %v", info.token, err)
+
+	b.config.quota.record(info.hash, int64(len(data)))
+	return int64(len(data)), nil
+}
+
+// checkPage verifies that the dataset of the page is available, recording its use
+func (b *baseHandler) checkPage(info *pageInfo) error {
+	if err := b.config.datasets.checkAvailable(info.hash); err != nil {
+		b.Error("Page %v: Dataset unavailable - %v", info.token, err)
+		if err == errDatasetExpired {
+			return err
+		}
+		return fmt.Errorf("invalid request or page token")
 	}
 
-	return err
+	b.config.quota.touch(info.hash)
+	return nil
 }
 
 // retrievePage returns decrypted byte slice
@@ -154,51 +233,118 @@ func (b *baseHandler) retrievePage(info *pageInfo) (page []byte, err error) {
 	b.Info("Page %v: Retrieving", info.token)
 	defer b.Info("Page %v: Completed retrieval", info.token)
 
-	pageLocation := b.getCacheFileName(info)
+	// The dataset cannot be removed whilst the page is read from the store
+	unlock := b.config.datasets.readLock(info.hash)
+	if err = b.checkPage(info); err != nil {
+		unlock()
+		return nil, err
+	}
 
-	b.Debug("Page %v: Reading from Disk", info.token)
-	page, err = ioutil.ReadFile(pageLocation)
-	b.Debug("Page %v: Reading from Disk completed", info.token)
+	b.Debug("Page %v: Reading from store", info.token)
+	key := b.getPageKey(info)
+	raw, err := b.config.store.Get(info.hash, key)
+	unlock()
+	b.Debug("Page %v: Reading from store completed", info.token)
 	if err != nil {
-		b.Error("Page %v: Error reading from disk - %v", info.token, err)
+		b.Error("Page %v: Error reading from store - %v", info.token, err)
 		return nil, fmt.Errorf("invalid request or page token")
 	}
 
-	// If a key is provided, assume the page is encrypted
-	if b.config.cipher != nil {
-		b.Debug("Page %v: Decrypting", info.token)
+	env, page, err := b.config.readEnvelope(raw)
+	if err != nil {
+		b.Error("Page %v: Error reading envelope - %v", info.token, err)
+		return nil, fmt.Errorf("internal failure handling page (5)")
+	}
+
+	page, err = b.decryptPage(env, page, info, key)
+	if err != nil {
+		return nil, err
+	}
 
-		gcm, err := cipher.NewGCM(b.config.cipher)
+	var stored *codec
+	if env.codec != codecNone {
+		var ok bool
+		if stored, ok = codecs[env.codec]; !ok {
+			b.Error("Page %v: Unsupported codec %v", info.token, env.codec)
+			return nil, fmt.Errorf("internal failure handling page (4)")
+		}
+	}
+
+	// Return the stored bytes as-is if the client accepts their codec
+	if info.useCompression && stored != nil && info.accepts(stored) {
+		b.Debug("Page %v: Returning %v encoded", info.token, stored.encoding)
+		info.encoding = stored.encoding
+		return page, nil
+	}
+
+	// uncompress, as the client does not accept the stored codec
+	if stored != nil {
+		page, err = b.uncompressData(page, stored, info.token)
 		if err != nil {
-			b.Error("Page %v: Error creating GCM - %v", info.token, err)
-			return nil, fmt.Errorf("internal failure handling page (1)")
+			return nil, err
 		}
+	}
+
+	// Transcode to a codec the client accepts, if configured to do so
+	if info.useCompression && b.config.transcode {
+		if c := info.acceptedCodec(); c != nil {
+			b.Debug("Page %v: Transcoding to %v", info.token, c.encoding)
+			page, err = b.compressData(page, c, info.token)
+			if err != nil {
+				return nil, fmt.Errorf("internal failure handling page (4)")
+			}
+			info.encoding = c.encoding
+		}
+	}
 
-		nonceSize := gcm.NonceSize()
-		if len(page) < nonceSize {
-			b.Error("Page %v: Data inconsistency", info.token)
-			return nil, fmt.Errorf("internal failure handling page (2)")
+	return
+}
+
+// decryptPage returns the decrypted payload of the page with the envelope and key
+func (b *baseHandler) decryptPage(env *pageEnvelope, page []byte, info *pageInfo, key string) ([]byte, error) {
+	switch env.encryption {
+	case encryptionNone:
+	case encryptionAESGCM:
+		block, err := b.config.keys.key(env.keyID)
+		if err != nil {
+			b.Error("Page %v: Key %v is not available", info.token, env.keyID)
+			return nil, fmt.Errorf("internal failure handling page (6)")
 		}
 
-		nonce, data := page[:nonceSize], page[nonceSize:]
-		page, err = gcm.Open(nil, nonce, data, nil)
+		b.Debug("Page %v: Decrypting with key %v", info.token, env.keyID)
+
+		page, err = unseal(block, page, pageAAD(env, info.hash, key))
 		if err != nil {
 			b.Error("Page %v: Error decrypting - %v", info.token, err)
 			return nil, fmt.Errorf("internal failure handling page (3)")
 		}
 
 		b.Debug("Page %v: Decrypted", info.token)
-	}
+	case encryptionDataKey:
+		if b.config.dataKeys == nil {
+			b.Error("Page %v: No key manager for data key", info.token)
+			return nil, fmt.Errorf("internal failure handling page (6)")
+		}
 
-	// uncompress if requested
-	if !info.useCompression {
-		if b.config.useCompression {
-			page, err = b.uncompressData(page, info.token)
-			if err != nil {
-				return nil, err
-			}
+		block, err := b.config.dataKeys.block(info.hash)
+		if err != nil {
+			b.Error("Page %v: Data key is not available - %v", info.token, err)
+			return nil, fmt.Errorf("internal failure handling page (6)")
 		}
+
+		b.Debug("Page %v: Decrypting with data key", info.token)
+
+		page, err = unseal(block, page, pageAAD(env, info.hash, key))
+		if err != nil {
+			b.Error("Page %v: Error decrypting - %v", info.token, err)
+			return nil, fmt.Errorf("internal failure handling page (3)")
+		}
+
+		b.Debug("Page %v: Decrypted", info.token)
+	default:
+		b.Error("Page %v: Unsupported encryption scheme %v", info.token, env.encryption)
+		return nil, fmt.Errorf("internal failure handling page (6)")
 	}
 
-	return
+	return page, nil
 }
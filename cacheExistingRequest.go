@@ -1,13 +1,19 @@
 package main
 
 import (
+	"context"
 	"encoding/csv"
 	"encoding/json"
 	"io"
 	"net/http"
 	"os"
+	"path/filepath"
+	"time"
 )
 
+// requestHashHeader is the response header identifying the dataset created by the request
+const requestHashHeader = "X-Request-Hash"
+
 // Column specifies a column of data in the file
 type Column struct {
 	Name string `json:"name"`
@@ -20,6 +26,8 @@ type ExistingRequest struct {
 	CSVFileName    string   `json:"file_name"`
 	Columns        []Column `json:"columns"`
 	RecordsPerPage int      `json:"records_per_page"`
+	TTLSeconds     int      `json:"ttl_seconds"`
+	Codec          string   `json:"codec"`
 }
 
 // NewExistingRequestHandlerFactory returns a factory instance that manufactures Handlers
@@ -52,6 +60,31 @@ type firstPageInfo struct {
 	token       string
 }
 
+// canonicalRequest returns the parts of the request, and the identity of the version
+// of the file, that determine the content of the dataset
+func (m *existingFileRequestHandler) canonicalRequest(p *ExistingRequest, stat os.FileInfo) interface{} {
+	fileName, err := filepath.Abs(p.CSVFileName)
+	if err != nil {
+		fileName = p.CSVFileName
+	}
+
+	return struct {
+		Kind           string   `json:"kind"`
+		FileName       string   `json:"file_name"`
+		Size           int64    `json:"size"`
+		Modified       int64    `json:"modified"`
+		Columns        []Column `json:"columns"`
+		RecordsPerPage int      `json:"records_per_page"`
+	}{
+		Kind:           "existing",
+		FileName:       fileName,
+		Size:           stat.Size(),
+		Modified:       stat.ModTime().UnixNano(),
+		Columns:        p.Columns,
+		RecordsPerPage: p.RecordsPerPage,
+	}
+}
+
 // handleCreatePages is invoked after the initial authorization and validation checks are completed,
 // and creates caches pages of the specified file.
 func (m *existingFileRequestHandler) handleCreatePages(w http.ResponseWriter, req *http.Request) {
@@ -65,6 +98,13 @@ func (m *existingFileRequestHandler) handleCreatePages(w http.ResponseWriter, re
 		return
 	}
 
+	// Use the requested codec, rather than the configured codec
+	m.codec, err = codecByName(p.Codec)
+	if err != nil {
+		returnError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// Attempt to open the file
 	file, err := os.Open(p.CSVFileName)
 	if err != nil {
@@ -73,44 +113,186 @@ func (m *existingFileRequestHandler) handleCreatePages(w http.ResponseWriter, re
 		return
 	}
 
-	// Hash should be generated from the request; here is it just a UUID
-	hash := NewUUID()
+	// The CSV file size is used as the estimate of the dataset size, as the
+	// JSON representation of the records is of similar size
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		m.Error("%v", err)
+		returnError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	// token to the first page of data
-	firstPageToken := NewUUID()
+	// Hash is derived from the request and the version of the file, so that
+	// identical requests return the dataset already cached
+	hash, err := m.requestHash(m.canonicalRequest(&p, stat))
+	if err != nil {
+		file.Close()
+		returnError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Concurrent identical requests share a single ingest
+	token, shared, err := m.config.ingests.do(hash, func() (interface{}, error) {
+		info, err := m.cachedDataset(hash)
+		if err != nil {
+			return nil, err
+		}
+		if info != nil {
+			m.Debug("Returning cached dataset - hash: %v", hash)
+			file.Close()
+			return info.Tokens[0], nil
+		}
+
+		// The checkpoint of the ingest determines the tokens of its pages
+		cp := newIngestCheckpoint(&p, stat)
+		firstPageToken := cp.NextToken
 
-	// Asynchronously generate the page data in the cache
-	m.Debug("Starting page generation - hash: %v, first page: %v", hash, firstPageToken)
-	go m.cacheData(hash, firstPageToken, &p, file)
+		info = &datasetInfo{
+			Hash:    hash,
+			Tokens:  []string{firstPageToken},
+			Kind:    "existing",
+			Source:  cp.FileName,
+			Columns: p.Columns,
+		}
+		if err := m.createDataset(info, p.TTLSeconds, stat.Size()); err != nil {
+			return nil, err
+		}
+
+		// Asynchronously generate the page data in the cache, with progress reported by the job
+		m.Debug("Starting page generation - hash: %v, first page: %v", hash, firstPageToken)
+		if err := m.startIngest(hash, cp, file); err != nil {
+			m.discardDataset(hash)
+			return nil, err
+		}
+		return firstPageToken, nil
+	})
+	if shared || err != nil {
+		file.Close()
+	}
+	if err == errQuotaExceeded {
+		returnError(w, err.Error(), http.StatusInsufficientStorage)
+		return
+	}
+	if err == errIngestRunning {
+		returnError(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		returnError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	firstPageToken := token.(string)
 
 	// Create initial response, which is empty and points to the first page
 	m.Debug("Creating empty first page")
 	b := m.createPageBytes(firstPageToken, p.Columns, [][]string{})
 
-	// Return the first page
+	// Return the first page, with the hash needed to request pages and follow the ingest
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(requestHashHeader, hash)
 	w.WriteHeader(http.StatusOK)
 	w.Write(b)
 }
 
-// cacheData reads records from the file, creating cache pages until EOF is reached
-func (m *existingFileRequestHandler) cacheData(hash, firstPageToken string, req *ExistingRequest, file *os.File) error {
+// startIngest starts the job that caches the pages of the file, from the checkpoint,
+// which is saved first so that the ingest can be resumed should the process stop
+func (m *existingFileRequestHandler) startIngest(hash string, cp *ingestCheckpoint, file *os.File) error {
+	if err := m.config.saveCheckpoint(hash, cp); err != nil {
+		m.Error("Error saving ingest checkpoint - hash: %v, %v", hash, err)
+		return err
+	}
+
+	m.job = m.config.jobs.start(hash, "existing")
+	m.job.resumeFrom(cp.Pages, cp.Pages*cp.Request.RecordsPerPage)
+	m.job.addPending(cp.NextToken)
+	go func() {
+		ctx := m.job.context()
+		err := m.cacheData(ctx, hash, cp, file)
+		if err != nil && ctx.Err() == nil {
+			m.job.fail(err)
+		}
+		if m.job.stopped() {
+			m.discardDataset(hash)
+		} else if err := m.config.store.Delete(hash, checkpointKey); err != nil {
+			m.Error("Error removing ingest checkpoint - hash: %v, %v", hash, err)
+		}
+		m.job.finish()
+	}()
+	return nil
+}
+
+// cacheData reads records from the file, from the checkpoint, creating cache pages
+// until EOF is reached or ctx is cancelled.  Pages are written by a pageWriter, which
+// holds back reading whilst its workers are busy, and the checkpoint is saved as the
+// pages from the first that have all been written advance.
+func (m *existingFileRequestHandler) cacheData(ctx context.Context, hash string, cp *ingestCheckpoint, file *os.File) error {
 	// Ensure the file is always closed
 	defer file.Close()
 
-	// Current page is initially the first page
-	curPageToken := firstPageToken
+	if _, err := file.Seek(cp.Offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	// Complete the dataset once all pages have been written, with the tokens of its pages
+	req := &cp.Request
+	writer := newPageWriter(ctx, &m.writeHandler, hash, req.Columns, m.config.ingestWorkers, cp.Pages)
+	defer func() {
+		pages, _ := writer.contiguous()
+		m.completeDataset(hash, cp.tokens(pages), m.job.Status().Rows)
+	}()
 
-	// CSV based file
+	// The writer calls checkpoint under its lock, so checkpoints are saved in order
+	var saved time.Time
+	writer.checkpoint = func(last *pageJob, ready int) {
+		// The final page completes the ingest, so is not checkpointed
+		if last.nextToken == "" || time.Since(saved) < checkpointInterval {
+			return
+		}
+		next := *cp
+		next.Pages = ready
+		next.LastToken = last.token
+		next.Offset = last.nextOffset
+		next.NextToken = last.nextToken
+		if err := m.config.saveCheckpoint(hash, &next); err != nil {
+			m.Error("Error saving ingest checkpoint - hash: %v, %v", hash, err)
+			return
+		}
+		saved = time.Now()
+	}
+
+	err := m.readPages(ctx, hash, cp, file, writer)
+	if werr := writer.close(); err == nil {
+		err = werr
+	}
+	return err
+}
+
+// readPages reads records from the file, submitting each page to the writer
+func (m *existingFileRequestHandler) readPages(ctx context.Context, hash string, cp *ingestCheckpoint, file *os.File, writer *pageWriter) error {
+	req := &cp.Request
+
+	// Current page is initially the next page of the checkpoint
+	curPageToken := cp.NextToken
+	seq := cp.Pages
+
+	// CSV based file, whose offsets are relative to that of the checkpoint
 	csvReader := csv.NewReader(file)
+	var offset int64
 
-	records := [][]string{}
+	records := make([][]string, 0, req.RecordsPerPage+1)
 
 endOfFile:
 	for {
 
+		if err := ctx.Err(); err != nil {
+			m.Info("Page generation cancelled - hash: %v", hash)
+			return err
+		}
+
 		for len(records) <= req.RecordsPerPage {
 
+			offset = csvReader.InputOffset()
 			record, err := csvReader.Read()
 			if err == io.EOF {
 				break endOfFile
@@ -126,21 +308,36 @@ endOfFile:
 
 		// Having read 1 more record than a page should have, we
 		// know that another page is required, so create its token
-		nextPageToken := NewUUID()
+		nextPageToken := cp.token(seq + 1)
+		m.job.addPending(nextPageToken)
+
+		m.job.addRows(req.RecordsPerPage)
 
-		// Asynchronous write now that we have the data
-		go m.createPage(hash, curPageToken, nextPageToken, req.Columns, records[0:req.RecordsPerPage])
+		// Each page has its own records, as the writer holds them until written.
+		// The extra record, read from offset, is the first of the next page.
+		err := writer.submit(&pageJob{
+			seq:        seq,
+			token:      curPageToken,
+			nextToken:  nextPageToken,
+			records:    records[0:req.RecordsPerPage],
+			nextOffset: cp.Offset + offset,
+		})
+		if err != nil {
+			return err
+		}
 
 		// Reset for next page
+		seq++
 		curPageToken = nextPageToken
-		records = [][]string{records[req.RecordsPerPage]}
+		next := make([][]string, 0, req.RecordsPerPage+1)
+		records = append(next, records[req.RecordsPerPage])
 	}
 
 	// Final page - identified by an empty token
-	err := m.createPage(hash, curPageToken, "", req.Columns, records)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	m.job.addRows(len(records))
+	return writer.submit(&pageJob{
+		seq:     seq,
+		token:   curPageToken,
+		records: records,
+	})
 }
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	lz4 "github.com/pierrec/lz4"
+)
+
+// codec describes a compression format that pages may be stored in.  The ID is
+// recorded in the envelope of each page, so must never change.
+type codec struct {
+	id   byte
+	name string
+	// encoding is the HTTP content-coding of the format, if it has one
+	encoding string
+	// newWriter returns a writer compressing to w at the level, where zero is the default
+	newWriter func(w io.Writer, level int) (io.WriteCloser, error)
+	// newReader returns a reader decompressing r
+	newReader func(r io.Reader) (io.ReadCloser, error)
+}
+
+// codecs is the registry of supported compression formats, by ID
+var codecs = map[byte]*codec{
+	codecLZ4: {
+		id:   codecLZ4,
+		name: "lz4",
+		newWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return lz4.NewWriter(w), nil
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return ioutil.NopCloser(lz4.NewReader(r)), nil
+		},
+	},
+	codecZstd: {
+		id:       codecZstd,
+		name:     "zstd",
+		encoding: "zstd",
+		newWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			opts := []zstd.EOption{zstd.WithEncoderConcurrency(1)}
+			if level != 0 {
+				opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+			}
+			return zstd.NewWriter(w, opts...)
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				return nil, err
+			}
+			return d.IOReadCloser(), nil
+		},
+	},
+	codecSnappy: {
+		id:   codecSnappy,
+		name: "snappy",
+		newWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return snappy.NewBufferedWriter(w), nil
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return ioutil.NopCloser(snappy.NewReader(r)), nil
+		},
+	},
+	codecGzip: {
+		id:       codecGzip,
+		name:     "gzip",
+		encoding: "gzip",
+		newWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			if level == 0 {
+				level = gzip.DefaultCompression
+			}
+			return gzip.NewWriterLevel(w, level)
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+}
+
+// noCodec is requested by the name "none", so that pages are stored uncompressed
+// whatever the configured codec.  It is not in the registry, as it has no format.
+var noCodec = &codec{id: codecNone, name: "none"}
+
+// codecByName returns the codec with the name; the empty name returns nil, so
+// that the configured codec applies, and "none" returns noCodec
+func codecByName(name string) (*codec, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		return nil, nil
+	}
+	if name == noCodec.name {
+		return noCodec, nil
+	}
+	for _, c := range codecs {
+		if c.name == name {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported codec: %v (supported codecs are %v)", name, strings.Join(codecNames(), ", "))
+}
+
+// codecByEncoding returns the codec with the HTTP content-coding, or nil if there is none
+func codecByEncoding(encoding string) *codec {
+	for _, c := range codecs {
+		if c.encoding != "" && c.encoding == encoding {
+			return c
+		}
+	}
+	return nil
+}
+
+// codecNames returns the names of all supported codecs
+func codecNames() []string {
+	names := []string{}
+	for _, c := range codecs {
+		names = append(names, c.name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestCodecNoneOverridesConfiguredCodec(t *testing.T) {
+	config := newTestCacheConfig(t, cacheOptions{codec: "zstd"})
+
+	c, err := codecByName("none")
+	if err != nil || c == nil {
+		t.Fatalf("codecByName(none) returned %v - %v", c, err)
+	}
+
+	m := &writeHandler{baseHandler: baseHandler{config: config, requestID: "test"}, codec: c}
+	info := &datasetInfo{Hash: "dataset", Tokens: []string{NewUUID()}}
+	if err := m.createDataset(info, 0, 0); err != nil {
+		t.Fatalf("createDataset - %v", err)
+	}
+	if info.Codec != "none" {
+		t.Fatalf("dataset recorded codec %q, expected none", info.Codec)
+	}
+
+	page := &pageInfo{hash: info.Hash, token: info.Tokens[0], codec: c}
+	if _, err := m.writePage([]byte(`{"rows":[]}`), page); err != nil {
+		t.Fatalf("writePage - %v", err)
+	}
+	raw, err := config.store.Get(info.Hash, m.getPageKey(page))
+	if err != nil {
+		t.Fatalf("Get - %v", err)
+	}
+	env, _, err := config.readEnvelope(raw)
+	if err != nil {
+		t.Fatalf("readEnvelope - %v", err)
+	}
+	if env.codec != codecNone {
+		t.Fatalf("page stored with codec %v, expected none", env.codec)
+	}
+}
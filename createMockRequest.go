@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"math/rand"
@@ -25,6 +26,11 @@ type MockCreateRequest struct {
 	RecordCount    int          `json:"max_records"`
 	Columns        []MockColumn `json:"columns"`
 	RecordsPerPage int          `json:"records_per_page"`
+	TTLSeconds     int          `json:"ttl_seconds"`
+	Codec          string       `json:"codec"`
+	// Seed makes the generated records repeatable, so that identical requests with
+	// a seed return the same dataset; without a seed every request is distinct
+	Seed *int64 `json:"seed,omitempty"`
 }
 
 // MockCreateResponse provides the details to be able to recover any of the pages
@@ -56,6 +62,7 @@ func (f *mockCreatRequestHandlerFactory) New(pattern string, config *cacheConfig
 
 type mockCreatRequestHandler struct {
 	writeHandler
+	rand *rand.Rand
 }
 
 // handleCreatePages is invoked after the initial authorization and validation checks are completed,
@@ -70,23 +77,93 @@ func (m *mockCreatRequestHandler) handleCreatePages(w http.ResponseWriter, req *
 		return
 	}
 
-	// Generate the data in the cache
-	resp, err := m.createMockData(&p)
+	// Use the requested codec, rather than the configured codec
+	m.codec, err = codecByName(p.Codec)
 	if err != nil {
 		returnError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
+	// Without a seed, the records are generated from a random seed
+	if p.Seed == nil {
+		seed := rand.Int63()
+		p.Seed = &seed
+	}
+	m.rand = rand.New(rand.NewSource(*p.Seed))
+
+	// Hash is derived from the request, so that identical requests return the dataset already cached
+	hash, err := m.requestHash(m.canonicalRequest(&p))
+	if err != nil {
+		returnError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Generate the data in the cache, with concurrent identical requests sharing the generation
+	v, _, err := m.config.ingests.do(hash, func() (interface{}, error) {
+		info, err := m.cachedDataset(hash)
+		if err != nil {
+			return nil, err
+		}
+		if info != nil {
+			m.Debug("Returning cached dataset - hash: %v", hash)
+			return &MockCreateResponse{RequestHash: hash, PageTokens: info.Tokens}, nil
+		}
+
+		resp, err := m.createMockData(hash, &p)
+		if err != nil && err != errQuotaExceeded {
+			m.discardDataset(hash)
+		}
+		if m.job != nil {
+			if err != nil && err != context.Canceled {
+				m.job.fail(err)
+			}
+			m.job.finish()
+		}
+		return resp, err
+	})
+	if err == errQuotaExceeded {
+		returnError(w, err.Error(), http.StatusInsufficientStorage)
+		return
+	}
+	if err == context.Canceled {
+		returnError(w, "dataset creation was cancelled", http.StatusConflict)
+		return
+	}
+	if err == errIngestRunning {
+		returnError(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		returnError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp := v.(*MockCreateResponse)
+
 	// Return details of created pages
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(resp)
 }
 
-func (m *mockCreatRequestHandler) createMockData(req *MockCreateRequest) (*MockCreateResponse, error) {
+// canonicalRequest returns the parts of the request that determine the content of the dataset
+func (m *mockCreatRequestHandler) canonicalRequest(p *MockCreateRequest) interface{} {
+	return struct {
+		Kind           string       `json:"kind"`
+		RecordCount    int          `json:"max_records"`
+		Columns        []MockColumn `json:"columns"`
+		RecordsPerPage int          `json:"records_per_page"`
+		Seed           int64        `json:"seed"`
+	}{
+		Kind:           "mock",
+		RecordCount:    p.RecordCount,
+		Columns:        p.Columns,
+		RecordsPerPage: p.RecordsPerPage,
+		Seed:           *p.Seed,
+	}
+}
 
-	// Hash should be generated from the request; here is it just a UUID
-	hash := NewUUID()
+func (m *mockCreatRequestHandler) createMockData(hash string, req *MockCreateRequest) (*MockCreateResponse, error) {
 
 	// Only create a single page of data for now; token is a UUID
 	curPageToken := NewUUID()
@@ -96,6 +173,13 @@ func (m *mockCreatRequestHandler) createMockData(req *MockCreateRequest) (*MockC
 		cols = append(cols, Column{Name: col.Name, Type: col.Type})
 	}
 
+	info := &datasetInfo{Hash: hash, Kind: "mock", Columns: cols}
+	if err := m.createDataset(info, req.TTLSeconds, m.estimateSize(req)); err != nil {
+		return nil, err
+	}
+	m.job = m.config.jobs.start(hash, "create")
+	ctx := m.job.context()
+
 	resp := &MockCreateResponse{
 		RequestHash: hash,
 		PageTokens:  []string{curPageToken},
@@ -115,8 +199,9 @@ func (m *mockCreatRequestHandler) createMockData(req *MockCreateRequest) (*MockC
 
 		if remainingRecords > 0 {
 			nextPageToken := NewUUID()
+			m.job.addRows(len(records))
 
-			err := m.createPage(hash, curPageToken, nextPageToken, cols, records)
+			err := m.createPage(ctx, hash, curPageToken, nextPageToken, cols, records)
 			if err != nil {
 				return nil, err
 			}
@@ -128,23 +213,46 @@ func (m *mockCreatRequestHandler) createMockData(req *MockCreateRequest) (*MockC
 
 	}
 
-	err := m.createPage(hash, curPageToken, "", cols, records)
+	m.job.addRows(len(records))
+	err := m.createPage(ctx, hash, curPageToken, "", cols, records)
 	if err != nil {
 		return nil, err
 	}
 
+	if err := m.completeDataset(hash, resp.PageTokens, int64(req.RecordCount)); err != nil {
+		return nil, err
+	}
+
 	m.Debug("Hash: %v, Pages: %v", resp.RequestHash, resp.PageTokens)
 	return resp, nil
 }
 
+// estimateSize returns the approximate number of bytes needed to hold the
+// JSON representation of the requested records
+func (m *mockCreatRequestHandler) estimateSize(req *MockCreateRequest) int64 {
+	// Allow for the brackets of each record, and quotes and separator of each value
+	var recordSize int64 = 2
+	for _, col := range req.Columns {
+		switch strings.ToLower(col.Type) {
+		case "string":
+			recordSize += int64(col.MaxLength)/2 + 3
+		case "int":
+			recordSize += 20 + 3
+		default:
+			recordSize += 24 + 3
+		}
+	}
+	return recordSize * int64(req.RecordCount)
+}
+
 func (m *mockCreatRequestHandler) createRandomString(maxLength int) string {
 	available := "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz012346789"
 
-	length := rand.Intn(maxLength)
+	length := m.rand.Intn(maxLength)
 
 	ret := ""
 	for i := 0; i < length; i++ {
-		c := rand.Intn(len(available))
+		c := m.rand.Intn(len(available))
 		ret = ret + available[c:c+1]
 	}
 	return ret
@@ -160,7 +268,7 @@ func (m *mockCreatRequestHandler) createRandomInt(lowerBound, upperBound int) in
 	if lowerBound < 0 && upperBound < 0 {
 		return -m.createRandomInt(-upperBound, -lowerBound)
 	}
-	return rand.Intn(upperBound-lowerBound) + lowerBound
+	return m.rand.Intn(upperBound-lowerBound) + lowerBound
 }
 
 func (m *mockCreatRequestHandler) createRandomFloat64(lowerBound, upperBound float64) float64 {
@@ -173,7 +281,7 @@ func (m *mockCreatRequestHandler) createRandomFloat64(lowerBound, upperBound flo
 	if lowerBound < 0 && upperBound < 0 {
 		return -m.createRandomFloat64(-upperBound, -lowerBound)
 	}
-	return rand.Float64()*(upperBound-lowerBound) + lowerBound
+	return m.rand.Float64()*(upperBound-lowerBound) + lowerBound
 }
 
 func (m *mockCreatRequestHandler) createRecord(cols []MockColumn) []string {
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gford1000-go/logger"
+)
+
+// datasetKey is the reserved key under which the metadata of a dataset is held
+// in the PageStore, alongside its pages
+const datasetKey = "dataset.json"
+
+// missingRecheck is how long the absence of metadata for a dataset is remembered,
+// before the PageStore is checked again
+const missingRecheck = time.Minute
+
+// maxMissing bounds the datasets whose absence is remembered, as any request can
+// name a dataset that does not exist
+const maxMissing = 100000
+
+// expiredRetention is how long datasets removed on expiry continue to be reported
+// as expired, rather than as unknown
+const expiredRetention = 24 * time.Hour
+
+// errDatasetExpired is returned when a page is requested from an expired dataset
+var errDatasetExpired = errors.New("dataset expired")
+
+// datasetInfo is the metadata describing a dataset
+type datasetInfo struct {
+	Hash    string    `json:"hash"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+	Bytes   int64     `json:"bytes"`
+
+	// Tokens are the page tokens of the dataset, in order, so that the same response
+	// can be returned to identical requests.  Whilst the dataset is being ingested,
+	// only the tokens returned to the request that created it are known.
+	Tokens []string `json:"tokens,omitempty"`
+
+	// The manifest of the dataset, describing how it was created and its content.
+	// Source is the file ingested, and Rows and Pages are set once it is complete.
+	Kind    string   `json:"kind,omitempty"`
+	Source  string   `json:"source,omitempty"`
+	Columns []Column `json:"columns,omitempty"`
+	Rows    int64    `json:"rows"`
+	Pages   int      `json:"pages"`
+	Codec   string   `json:"codec,omitempty"`
+
+	// KeyID identifies the keyring key with which the pages are encrypted, when
+	// no KeyManager is configured
+	KeyID string `json:"key_id,omitempty"`
+
+	// DataKey is the wrapped key with which the pages of the dataset are encrypted,
+	// when a KeyManager is configured, and DataKeyID identifies its master key
+	DataKey   []byte `json:"data_key,omitempty"`
+	DataKeyID string `json:"data_key_id,omitempty"`
+}
+
+// expired returns true if the dataset has an expiry that has passed
+func (d *datasetInfo) expired(now time.Time) bool {
+	return !d.Expires.IsZero() && now.After(d.Expires)
+}
+
+// sweepResult reports the outcome of the most recent sweep of expired datasets
+type sweepResult struct {
+	Completed time.Time `json:"completed"`
+	Removed   int       `json:"removed"`
+	Reclaimed int64     `json:"reclaimed"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// datasetLock is held shared whilst the pages of a dataset are read, and exclusively
+// whilst the dataset is removed, so that pages are never read from a partly removed
+// dataset.  meta is held whilst the metadata of the dataset is updated or removed.
+// It is counted, so that it is discarded once no longer held.
+type datasetLock struct {
+	sync.RWMutex
+	meta sync.Mutex
+	refs int
+}
+
+// datasetRegistry maintains the metadata of the datasets in a PageStore
+type datasetRegistry struct {
+	store     PageStore
+	lock      sync.Mutex
+	datasets  map[string]*datasetInfo
+	locks     map[string]*datasetLock
+	missing   map[string]time.Time
+	expired   map[string]time.Time
+	lastSweep sweepResult
+	onRemove  []func(hash string)
+}
+
+// newDatasetRegistry returns a datasetRegistry for the PageStore
+func newDatasetRegistry(store PageStore) *datasetRegistry {
+	return &datasetRegistry{
+		store:    store,
+		datasets: map[string]*datasetInfo{},
+		locks:    map[string]*datasetLock{},
+		missing:  map[string]time.Time{},
+		expired:  map[string]time.Time{},
+	}
+}
+
+// save persists the metadata of the dataset
+func (r *datasetRegistry) save(info *datasetInfo) error {
+	b, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	if err := r.store.Put(info.Hash, datasetKey, b); err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.datasets[info.Hash] = info
+	delete(r.missing, info.Hash)
+	delete(r.expired, info.Hash)
+	return nil
+}
+
+// get returns the metadata of the dataset, or nil if the dataset has none
+func (r *datasetRegistry) get(hash string) (*datasetInfo, error) {
+	r.lock.Lock()
+	if info, ok := r.datasets[hash]; ok {
+		r.lock.Unlock()
+		return info, nil
+	}
+	if checked, ok := r.missing[hash]; ok && time.Since(checked) < missingRecheck {
+		r.lock.Unlock()
+		return nil, nil
+	}
+	r.lock.Unlock()
+
+	b, err := r.store.Get(hash, datasetKey)
+	if err == errPageNotFound {
+		r.lock.Lock()
+		if len(r.missing) >= maxMissing {
+			r.missing = map[string]time.Time{}
+		}
+		r.missing[hash] = time.Now()
+		r.lock.Unlock()
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	info := &datasetInfo{}
+	if err := json.Unmarshal(b, info); err != nil {
+		return nil, err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.datasets[hash] = info
+	delete(r.missing, hash)
+	return info, nil
+}
+
+// acquire returns the lock of the dataset, which must be released after use
+func (r *datasetRegistry) acquire(hash string) *datasetLock {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	l, ok := r.locks[hash]
+	if !ok {
+		l = &datasetLock{}
+		r.locks[hash] = l
+	}
+	l.refs++
+	return l
+}
+
+// release discards the lock of the dataset once it is no longer held
+func (r *datasetRegistry) release(hash string, l *datasetLock) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	l.refs--
+	if l.refs == 0 {
+		delete(r.locks, hash)
+	}
+}
+
+// update applies f to a copy of the current metadata of the dataset, saving the copy
+// if f returns true, which is reported.  Updates of a dataset are made
+// one at a time, so that none are lost, and are not made once the dataset is removed.
+func (r *datasetRegistry) update(hash string, f func(info *datasetInfo) bool) (bool, error) {
+	l := r.acquire(hash)
+	l.meta.Lock()
+	defer r.release(hash, l)
+	defer l.meta.Unlock()
+
+	info, err := r.get(hash)
+	if err != nil || info == nil {
+		return false, err
+	}
+
+	updated := *info
+	if !f(&updated) {
+		return false, nil
+	}
+	return true, r.save(&updated)
+}
+
+// readLock holds the dataset whilst its pages are read, preventing its removal,
+// until the returned function is called
+func (r *datasetRegistry) readLock(hash string) func() {
+	l := r.acquire(hash)
+	l.RLock()
+	return func() {
+		l.RUnlock()
+		r.release(hash, l)
+	}
+}
+
+// remove deletes the dataset from the PageStore, returning the bytes freed.
+// Removal waits for pages being read from the dataset.
+func (r *datasetRegistry) remove(hash string) (int64, error) {
+	l := r.acquire(hash)
+	l.Lock()
+	defer r.release(hash, l)
+	defer l.Unlock()
+
+	l.meta.Lock()
+	defer l.meta.Unlock()
+
+	freed, err := r.store.DeleteDataset(hash)
+	if err != nil {
+		return freed, err
+	}
+
+	r.lock.Lock()
+	delete(r.datasets, hash)
+	listeners := r.onRemove
+	r.lock.Unlock()
+
+	for _, f := range listeners {
+		f(hash)
+	}
+	return freed, nil
+}
+
+// notifyRemove registers a function to be called whenever a dataset is removed
+func (r *datasetRegistry) notifyRemove(f func(hash string)) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.onRemove = append(r.onRemove, f)
+}
+
+// checkAvailable returns errDatasetExpired if the dataset has expired,
+// whether or not it has been removed yet
+func (r *datasetRegistry) checkAvailable(hash string) error {
+	r.lock.Lock()
+	_, removed := r.expired[hash]
+	r.lock.Unlock()
+	if removed {
+		return errDatasetExpired
+	}
+
+	info, err := r.get(hash)
+	if err != nil {
+		return err
+	}
+	if info != nil && info.expired(time.Now()) {
+		return errDatasetExpired
+	}
+	return nil
+}
+
+// sweep removes all expired datasets from the PageStore.  Datasets without
+// metadata are never removed.  Datasets no longer remembered as missing, or
+// as expired, are forgotten.
+func (r *datasetRegistry) sweep() sweepResult {
+	result := sweepResult{}
+
+	r.prune(time.Now())
+
+	hashes, err := r.store.Datasets()
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	now := time.Now()
+	for _, hash := range hashes {
+		info, err := r.get(hash)
+		if err != nil || info == nil || !info.expired(now) {
+			continue
+		}
+
+		freed, err := r.remove(hash)
+		if err != nil {
+			result.Error = err.Error()
+			continue
+		}
+
+		r.lock.Lock()
+		r.expired[hash] = info.Expires
+		r.lock.Unlock()
+
+		result.Removed++
+		result.Reclaimed += freed
+	}
+
+	result.Completed = time.Now()
+
+	r.lock.Lock()
+	r.lastSweep = result
+	r.lock.Unlock()
+
+	return result
+}
+
+// prune forgets the datasets whose absence no longer needs to be remembered, and
+// those removed on expiry more than expiredRetention ago
+func (r *datasetRegistry) prune(now time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for hash, checked := range r.missing {
+		if now.Sub(checked) >= missingRecheck {
+			delete(r.missing, hash)
+		}
+	}
+	for hash, expires := range r.expired {
+		if now.Sub(expires) >= expiredRetention {
+			delete(r.expired, hash)
+		}
+	}
+}
+
+// startSweeper sweeps expired datasets at the specified interval, until the process exits
+func (r *datasetRegistry) startSweeper(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(interval) {
+			result := r.sweep()
+			logger.GetLogger()(logger.Info, "", "Dataset sweep removed %v datasets, reclaiming %v bytes", result.Removed, result.Reclaimed)
+			if result.Error != "" {
+				logger.GetLogger()(logger.Error, "", "Dataset sweep error - %v", result.Error)
+			}
+		}
+	}()
+}
+
+// Stats returns the outcome of the most recent sweep
+func (r *datasetRegistry) Stats() interface{} {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return struct {
+		Datasets  int         `json:"datasets"`
+		Expired   int         `json:"expired"`
+		LastSweep sweepResult `json:"last_sweep"`
+	}{
+		Datasets:  len(r.datasets),
+		Expired:   len(r.expired),
+		LastSweep: r.lastSweep,
+	}
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// datasetsPattern is the path under which datasets are identified by their hash
+const datasetsPattern = "/datasets/"
+
+// datasetsListPattern is the path at which the catalog of datasets is listed
+const datasetsListPattern = "/datasets"
+
+// defaultListLimit and maxListLimit bound the number of datasets in each page of the catalog
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// errForbiddenTenant is returned when a request addresses the datasets of another tenant
+var errForbiddenTenant = errors.New("datasets of other tenants are not accessible")
+
+// DatasetManifest describes the content of a dataset, and how it was created
+type DatasetManifest struct {
+	RequestHash string    `json:"hash"`
+	Kind        string    `json:"kind,omitempty"`
+	Source      string    `json:"source,omitempty"`
+	Columns     []Column  `json:"columns"`
+	Created     time.Time `json:"created"`
+	Expires     time.Time `json:"expires"`
+	Rows        int64     `json:"rows"`
+	Pages       int       `json:"pages"`
+	PageTokens  []string  `json:"tokens,omitempty"`
+	Bytes       int64     `json:"bytes"`
+	Codec       string    `json:"codec,omitempty"`
+	KeyID       string    `json:"key_id,omitempty"`
+}
+
+// newDatasetManifest returns the manifest of the dataset described by its metadata
+func newDatasetManifest(info *datasetInfo) *DatasetManifest {
+	m := &DatasetManifest{
+		RequestHash: info.Hash,
+		Kind:        info.Kind,
+		Source:      info.Source,
+		Columns:     info.Columns,
+		Created:     info.Created,
+		Expires:     info.Expires,
+		Rows:        info.Rows,
+		Pages:       info.Pages,
+		PageTokens:  info.Tokens,
+		Bytes:       info.Bytes,
+		Codec:       info.Codec,
+		KeyID:       info.KeyID,
+	}
+	// Pages sealed by a data key are identified by its master key
+	if info.DataKey != nil {
+		m.KeyID = info.DataKeyID
+	}
+	return m
+}
+
+// NewDatasetManifestHandlerFactory returns a factory instance that manufactures Handlers
+// which return the manifest of a dataset.
+func NewDatasetManifestHandlerFactory() HandlerFactory {
+	return &datasetManifestHandlerFactory{}
+}
+
+type datasetManifestHandlerFactory struct {
+}
+
+func (f *datasetManifestHandlerFactory) New(pattern string, config *cacheConfig, requestID string) Handler {
+	h := &datasetManifestHandler{}
+	h.method = http.MethodGet
+	h.config = config
+	h.handler = h.handleDatasetManifest
+	h.pattern = pattern
+	h.requestID = requestID
+
+	return h
+}
+
+type datasetManifestHandler struct {
+	baseHandler
+}
+
+// datasetHash returns the hash identified by the path of a request to datasetsPattern
+func datasetHash(req *http.Request) (string, error) {
+	hash := strings.TrimPrefix(req.URL.Path, datasetsPattern)
+	if err := validateHash(hash); err != nil {
+		return "", fmt.Errorf("invalid dataset: %v", hash)
+	}
+	return hash, nil
+}
+
+// handleDatasetManifest is invoked after the initial authorization and validation checks are completed,
+// and returns the manifest of the dataset identified by the path.  Whilst the dataset is
+// being ingested, 202 Accepted is returned with the status of the ingest instead.
+func (d *datasetManifestHandler) handleDatasetManifest(w http.ResponseWriter, req *http.Request) {
+
+	hash, err := datasetHash(req)
+	if err != nil {
+		returnError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if job := d.config.jobs.get(hash); job != nil {
+		if status := job.Status(); status.State == jobRunning {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Retry-After", strconv.Itoa(pendingRetryAfter))
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(status)
+			return
+		}
+	}
+
+	if err := d.config.datasets.checkAvailable(hash); err == errDatasetExpired {
+		returnError(w, err.Error(), http.StatusGone)
+		return
+	}
+	info, err := d.config.datasets.get(hash)
+	if err != nil {
+		d.Error("Error reading dataset %v - %v", hash, err)
+		returnError(w, "internal failure reading dataset", http.StatusInternalServerError)
+		return
+	}
+	if info == nil {
+		returnError(w, fmt.Sprintf("no dataset for %v", hash), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(newDatasetManifest(info))
+}
+
+// tenantCaches returns the caches whose datasets the request may address.  Requests
+// address the cache of their tenant, but those of admin tenants may address that of
+// the tenant specified, or by default all tenants.
+func (b *baseHandler) tenantCaches(tenant string) ([]*cacheConfig, error) {
+	all := b.config.allTenants
+	switch {
+	case tenant == "" && all != nil:
+		return all.caches(), nil
+	case tenant == "" || tenant == b.config.tenant:
+		return []*cacheConfig{b.config}, nil
+	case all == nil:
+		return nil, errForbiddenTenant
+	}
+
+	c := all.cache(tenant)
+	if c == nil {
+		return nil, fmt.Errorf("no tenant %v", tenant)
+	}
+	return []*cacheConfig{c}, nil
+}
+
+// DatasetListing describes a dataset in the catalog, without its page tokens
+type DatasetListing struct {
+	DatasetManifest
+	Tenant string `json:"tenant,omitempty"`
+	State  string `json:"state"`
+}
+
+// DatasetListResponse is a page of the catalog, ordered by tenant then hash.  Next
+// is provided as the "after" parameter to return the following page, and is empty
+// once the catalog is exhausted.
+type DatasetListResponse struct {
+	Datasets []DatasetListing `json:"datasets"`
+	Next     string           `json:"next,omitempty"`
+}
+
+// datasetFilter selects the datasets listed from the catalog
+type datasetFilter struct {
+	tenant        string
+	kind          string
+	source        string
+	createdAfter  time.Time
+	createdBefore time.Time
+	after         string
+	limit         int
+}
+
+// newDatasetFilter returns the filter specified by the query parameters of the request
+func newDatasetFilter(req *http.Request) (*datasetFilter, error) {
+	q := req.URL.Query()
+	f := &datasetFilter{
+		tenant: q.Get("tenant"),
+		kind:   q.Get("kind"),
+		source: q.Get("source"),
+		after:  q.Get("after"),
+		limit:  defaultListLimit,
+	}
+
+	var err error
+	if v := q.Get("created_after"); v != "" {
+		if f.createdAfter, err = time.Parse(time.RFC3339, v); err != nil {
+			return nil, fmt.Errorf("invalid created_after: %v", v)
+		}
+	}
+	if v := q.Get("created_before"); v != "" {
+		if f.createdBefore, err = time.Parse(time.RFC3339, v); err != nil {
+			return nil, fmt.Errorf("invalid created_before: %v", v)
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if f.limit, err = strconv.Atoi(v); err != nil || f.limit < 1 {
+			return nil, fmt.Errorf("invalid limit: %v", v)
+		}
+		if f.limit > maxListLimit {
+			f.limit = maxListLimit
+		}
+	}
+	return f, nil
+}
+
+// matches returns true if the dataset is selected by the filter
+func (f *datasetFilter) matches(info *datasetInfo) bool {
+	switch {
+	case f.kind != "" && info.Kind != f.kind:
+		return false
+	case f.source != "" && info.Source != f.source:
+		return false
+	case !f.createdAfter.IsZero() && !info.Created.After(f.createdAfter):
+		return false
+	case !f.createdBefore.IsZero() && !info.Created.Before(f.createdBefore):
+		return false
+	}
+	return true
+}
+
+// listingCursor returns the position of the dataset in the catalog, which is used
+// to resume listing after it
+func listingCursor(tenant, hash string) string {
+	return tenant + "/" + hash
+}
+
+// NewDatasetListHandlerFactory returns a factory instance that manufactures Handlers
+// which list the catalog of datasets.
+func NewDatasetListHandlerFactory() HandlerFactory {
+	return &datasetListHandlerFactory{}
+}
+
+type datasetListHandlerFactory struct {
+}
+
+func (f *datasetListHandlerFactory) New(pattern string, config *cacheConfig, requestID string) Handler {
+	h := &datasetListHandler{}
+	h.method = http.MethodGet
+	h.config = config
+	h.handler = h.handleDatasetList
+	h.pattern = pattern
+	h.requestID = requestID
+
+	return h
+}
+
+type datasetListHandler struct {
+	baseHandler
+}
+
+// handleDatasetList is invoked after the initial authorization and validation checks are completed,
+// and returns a page of the datasets selected by the query parameters
+func (d *datasetListHandler) handleDatasetList(w http.ResponseWriter, req *http.Request) {
+
+	filter, err := newDatasetFilter(req)
+	if err != nil {
+		returnError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	caches, err := d.tenantCaches(filter.tenant)
+	if err == errForbiddenTenant {
+		returnError(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		returnError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	// Tenants are listed in catalog order, until one more dataset than the page holds
+	// is found, so that only the metadata of the datasets on the page is read
+	sort.Slice(caches, func(i, j int) bool {
+		return listingCursor(caches[i].tenant, "") < listingCursor(caches[j].tenant, "")
+	})
+
+	listings := []DatasetListing{}
+	for _, c := range caches {
+		found, err := d.listDatasets(c, filter, filter.limit+1-len(listings))
+		if err != nil {
+			d.Error("Error listing datasets of tenant %v - %v", c.tenant, err)
+			returnError(w, "internal failure listing datasets", http.StatusInternalServerError)
+			return
+		}
+		listings = append(listings, found...)
+		if len(listings) > filter.limit {
+			break
+		}
+	}
+
+	resp := &DatasetListResponse{Datasets: listings}
+	if len(listings) > filter.limit {
+		resp.Datasets = listings[:filter.limit]
+		last := resp.Datasets[filter.limit-1]
+		resp.Next = listingCursor(last.Tenant, last.RequestHash)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// listDatasets returns, in catalog order, up to limit datasets of the cache selected by
+// the filter, after its cursor
+func (d *datasetListHandler) listDatasets(c *cacheConfig, filter *datasetFilter, limit int) ([]DatasetListing, error) {
+	hashes, err := c.store.Datasets()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(hashes)
+
+	listings := []DatasetListing{}
+	for _, hash := range hashes {
+		if len(listings) >= limit {
+			break
+		}
+		if filter.after != "" && listingCursor(c.tenant, hash) <= filter.after {
+			continue
+		}
+
+		// Datasets without metadata, or removed since listed, are not catalogued
+		info, err := c.datasets.get(hash)
+		if err != nil {
+			return nil, err
+		}
+		if info == nil || !filter.matches(info) {
+			continue
+		}
+
+		listing := DatasetListing{
+			DatasetManifest: *newDatasetManifest(info),
+			Tenant:          c.tenant,
+			State:           "available",
+		}
+		listing.PageTokens = nil
+		if job := c.jobs.get(hash); job != nil && job.Status().State == jobRunning {
+			listing.State = "ingesting"
+		} else if err := c.datasets.checkAvailable(hash); err == errDatasetExpired {
+			listing.State = "expired"
+		}
+		listings = append(listings, listing)
+	}
+	return listings, nil
+}
+
+// DatasetDeleteResponse reports the removal of a dataset
+type DatasetDeleteResponse struct {
+	RequestHash string `json:"hash"`
+	Tenant      string `json:"tenant,omitempty"`
+	FreedBytes  int64  `json:"freed_bytes"`
+}
+
+// NewDatasetDeleteHandlerFactory returns a factory instance that manufactures Handlers
+// which delete a dataset.
+func NewDatasetDeleteHandlerFactory() HandlerFactory {
+	return &datasetDeleteHandlerFactory{}
+}
+
+type datasetDeleteHandlerFactory struct {
+}
+
+func (f *datasetDeleteHandlerFactory) New(pattern string, config *cacheConfig, requestID string) Handler {
+	h := &datasetDeleteHandler{}
+	h.method = http.MethodDelete
+	h.config = config
+	h.handler = h.handleDatasetDelete
+	h.pattern = pattern
+	h.requestID = requestID
+
+	return h
+}
+
+type datasetDeleteHandler struct {
+	baseHandler
+}
+
+// handleDatasetDelete is invoked after the initial authorization and validation checks are completed,
+// and removes the dataset identified by the path, once pages being read from it have been read.
+// Datasets being ingested are not removed; their job must be cancelled instead.
+func (d *datasetDeleteHandler) handleDatasetDelete(w http.ResponseWriter, req *http.Request) {
+
+	hash, err := datasetHash(req)
+	if err != nil {
+		returnError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Admin tenants delete from their own cache unless another tenant is specified
+	c := d.config
+	if tenant := req.URL.Query().Get("tenant"); tenant != "" {
+		caches, err := d.tenantCaches(tenant)
+		if err == errForbiddenTenant {
+			returnError(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			returnError(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		c = caches[0]
+	}
+
+	info, err := c.datasets.get(hash)
+	if err != nil {
+		d.Error("Error reading dataset %v - %v", hash, err)
+		returnError(w, "internal failure reading dataset", http.StatusInternalServerError)
+		return
+	}
+	if info == nil {
+		returnError(w, fmt.Sprintf("no dataset for %v", hash), http.StatusNotFound)
+		return
+	}
+
+	// The dataset is only removed if its ingest is not running, and none starts meanwhile
+	freed, err := c.jobs.removeIdle(hash, c.datasets.remove)
+	if err == errIngestRunning {
+		returnError(w, fmt.Sprintf("dataset %v is being ingested; cancel its job instead", hash), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		d.Error("Error deleting dataset %v - %v", hash, err)
+		returnError(w, "internal failure deleting dataset", http.StatusInternalServerError)
+		return
+	}
+	d.Info("Deleted dataset %v, freeing %v bytes", hash, freed)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(&DatasetDeleteResponse{
+		RequestHash: hash,
+		Tenant:      c.tenant,
+		FreedBytes:  freed,
+	})
+}
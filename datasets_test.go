@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDatasetUpdateIsNotLost(t *testing.T) {
+	registry := newDatasetRegistry(newMemoryStore(1 << 20))
+	if err := registry.save(&datasetInfo{Hash: "h1"}); err != nil {
+		t.Fatalf("save - %v", err)
+	}
+
+	// Concurrent updates of different fields are each applied to the current metadata
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			registry.update("h1", func(info *datasetInfo) bool {
+				info.Rows++
+				return true
+			})
+		}()
+		go func() {
+			defer wg.Done()
+			registry.update("h1", func(info *datasetInfo) bool {
+				info.Tokens = append(info.Tokens, NewUUID())
+				return true
+			})
+		}()
+	}
+	wg.Wait()
+
+	info, err := registry.get("h1")
+	if err != nil {
+		t.Fatalf("get - %v", err)
+	}
+	if info.Rows != 10 || len(info.Tokens) != 10 {
+		t.Fatalf("updates lost: %v rows and %v tokens, expected 10 of each", info.Rows, len(info.Tokens))
+	}
+}
+
+func TestDatasetUpdateAfterRemove(t *testing.T) {
+	registry := newDatasetRegistry(newMemoryStore(1 << 20))
+	if err := registry.save(&datasetInfo{Hash: "h1"}); err != nil {
+		t.Fatalf("save - %v", err)
+	}
+	if _, err := registry.remove("h1"); err != nil {
+		t.Fatalf("remove - %v", err)
+	}
+
+	saved, err := registry.update("h1", func(info *datasetInfo) bool {
+		info.KeyID = "k2"
+		return true
+	})
+	if err != nil || saved {
+		t.Fatalf("update of removed dataset returned %v - %v, expected nothing saved", saved, err)
+	}
+	if info, _ := registry.get("h1"); info != nil {
+		t.Fatal("update recreated the removed dataset")
+	}
+}
+
+func TestDatasetRegistryForgetsMissingAndExpired(t *testing.T) {
+	registry := newDatasetRegistry(newMemoryStore(1 << 20))
+
+	for i := 0; i < maxMissing+10; i++ {
+		registry.get(fmt.Sprintf("unknown%v", i))
+	}
+	if n := len(registry.missing); n > maxMissing {
+		t.Fatalf("%v missing datasets remembered, expected at most %v", n, maxMissing)
+	}
+
+	now := time.Now()
+	registry.expired["old"] = now.Add(-expiredRetention - time.Minute)
+	registry.expired["recent"] = now.Add(-time.Minute)
+	registry.prune(now.Add(missingRecheck))
+
+	if len(registry.missing) != 0 {
+		t.Fatalf("%v missing datasets remembered after pruning", len(registry.missing))
+	}
+	if _, ok := registry.expired["old"]; ok {
+		t.Fatal("dataset expired beyond the retention window is remembered")
+	}
+	if _, ok := registry.expired["recent"]; !ok {
+		t.Fatal("recently expired dataset was forgotten")
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/gford1000-go/logger"
+)
+
+// tempSuffix identifies files that are being written, and are not yet pages
+const tempSuffix = ".tmp"
+
+// tempFilePattern matches the names of the temporary files created by writeFileAtomic
+// for pages (named by their 64 hex character key), metadata and checkpoints
+var tempFilePattern = regexp.MustCompile(`^([0-9a-f]{64}|` + regexp.QuoteMeta(datasetKey) + `|` +
+	regexp.QuoteMeta(checkpointKey) + `)\.[0-9]+` + regexp.QuoteMeta(tempSuffix) + `$`)
+
+// fileStore is a PageStore that holds each page as a separate file,
+// in a subfolder of root for each dataset
+type fileStore struct {
+	root string
+}
+
+// newFileStore returns a fileStore that uses the specified root folder
+func newFileStore(root string) *fileStore {
+	return &fileStore{root: root}
+}
+
+// datasetDir returns the folder holding the pages of the dataset
+func (f *fileStore) datasetDir(hash string) string {
+	return fmt.Sprintf("%v/%v", f.root, hash)
+}
+
+// pageFileName returns the name of the file holding the page
+func (f *fileStore) pageFileName(hash, key string) string {
+	return fmt.Sprintf("%v/%v/%v", f.root, hash, key)
+}
+
+func (f *fileStore) Put(hash, key string, data []byte) error {
+	if err := validateHash(hash); err != nil {
+		return err
+	}
+	// Create the subfolder for the dataset if it doesn't exist
+	if err := os.MkdirAll(f.datasetDir(hash), 0744); err != nil {
+		return err
+	}
+	return writeFileAtomic(f.pageFileName(hash, key), data)
+}
+
+// writeFileAtomic writes the data to a temporary file in the same folder, which is
+// synced and then renamed to fileName, so that readers never observe a partial file
+func writeFileAtomic(fileName string, data []byte) error {
+	i := strings.LastIndex(fileName, "/")
+	dir, name := fileName[:i], fileName[i+1:]
+
+	tmp, err := ioutil.TempFile(dir, name+".*"+tempSuffix)
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), fileName)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	// Sync the folder so that the rename is durable
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// RemoveTempFiles deletes temporary files left behind by writes that did not
+// complete, returning the number removed.  It must only be called before any
+// pages are written.
+func (f *fileStore) RemoveTempFiles() (int, error) {
+	return removeDatasetTempFiles(f.root, datasetKey, tempFilePattern.MatchString)
+}
+
+// removeDatasetTempFiles deletes the files in the dataset folders under root whose
+// names satisfy isTemp, returning the number removed.  Only folders holding a file
+// named marker are datasets; others, and those that cannot be read, are skipped, so
+// that the files of other programs sharing root are left alone.
+func removeDatasetTempFiles(root, marker string, isTemp func(name string) bool) (int, error) {
+	entries, err := ioutil.ReadDir(root)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, d := range entries {
+		if !d.IsDir() || validateHash(d.Name()) != nil {
+			continue
+		}
+		dir := fmt.Sprintf("%v/%v", root, d.Name())
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			logger.GetLogger()(logger.Warn, "", "Skipping %v when removing temporary files - %v", dir, err)
+			continue
+		}
+
+		isDataset := false
+		for _, e := range files {
+			if e.Name() == marker && !e.IsDir() {
+				isDataset = true
+			}
+		}
+		if !isDataset {
+			continue
+		}
+
+		for _, e := range files {
+			if !e.IsDir() && isTemp(e.Name()) {
+				if err := os.Remove(fmt.Sprintf("%v/%v", dir, e.Name())); err != nil {
+					return count, err
+				}
+				count++
+			}
+		}
+	}
+	return count, nil
+}
+
+func (f *fileStore) Get(hash, key string) ([]byte, error) {
+	if err := validateHash(hash); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(f.pageFileName(hash, key))
+	if os.IsNotExist(err) {
+		return nil, errPageNotFound
+	}
+	return data, err
+}
+
+func (f *fileStore) OpenPage(hash, key string) (*os.File, int64, int64, error) {
+	if err := validateHash(hash); err != nil {
+		return nil, 0, 0, err
+	}
+	file, err := os.Open(f.pageFileName(hash, key))
+	if os.IsNotExist(err) {
+		return nil, 0, 0, errPageNotFound
+	}
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, 0, err
+	}
+	return file, 0, stat.Size(), nil
+}
+
+func (f *fileStore) Delete(hash, key string) error {
+	if err := validateHash(hash); err != nil {
+		return err
+	}
+	err := os.Remove(f.pageFileName(hash, key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (f *fileStore) Datasets() ([]string, error) {
+	entries, err := ioutil.ReadDir(f.root)
+	if err != nil {
+		return nil, err
+	}
+	hashes := []string{}
+	for _, e := range entries {
+		if e.IsDir() && validateHash(e.Name()) == nil {
+			hashes = append(hashes, e.Name())
+		}
+	}
+	return hashes, nil
+}
+
+func (f *fileStore) DeleteDataset(hash string) (int64, error) {
+	if err := validateHash(hash); err != nil {
+		return 0, err
+	}
+	entries, err := ioutil.ReadDir(f.datasetDir(hash))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var freed int64
+	for _, e := range entries {
+		freed += e.Size()
+	}
+	return freed, os.RemoveAll(f.datasetDir(hash))
+}
+
+func (f *fileStore) List(hash string) ([]string, error) {
+	if err := validateHash(hash); err != nil {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir(f.datasetDir(hash))
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	for _, e := range entries {
+		if !e.IsDir() && !strings.HasSuffix(e.Name(), tempSuffix) {
+			keys = append(keys, e.Name())
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileStoreRemoveTempFiles(t *testing.T) {
+	root := t.TempDir()
+	key := strings.Repeat("ab", 32)
+	files := map[string]bool{
+		// Leftovers of the store's own writes are removed
+		"d1/dataset.json":             false,
+		"d1/" + key:                   false,
+		"d1/" + key + ".123456.tmp":   true,
+		"d1/dataset.json.98765.tmp":   true,
+		"d1/ingest.json.42.tmp":       true,
+		"d1/notes.tmp":                false,
+		"d1/" + key[:10] + ".123.tmp": false,
+		// Folders that are not datasets belong to others
+		"other/" + key + ".123456.tmp":        false,
+		"other/session.tmp":                   false,
+		"systemd-private-x/" + key + ".1.tmp": false,
+	}
+	for name := range files {
+		fileName := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fileName, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err := newFileStore(root).RemoveTempFiles()
+	if err != nil {
+		t.Fatalf("RemoveTempFiles - %v", err)
+	}
+	if n != 3 {
+		t.Errorf("RemoveTempFiles removed %v files, expected 3", n)
+	}
+	for name, removed := range files {
+		_, err := os.Stat(filepath.Join(root, name))
+		if removed != os.IsNotExist(err) {
+			t.Errorf("%v: removed %v, expected %v", name, os.IsNotExist(err), removed)
+		}
+	}
+}
+
+func TestFileStoreRemoveTempFilesSkipsUnreadable(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("folders are always readable by root")
+	}
+	root := t.TempDir()
+	private := filepath.Join(root, "private")
+	if err := os.Mkdir(private, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(private, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(private, 0700)
+
+	if _, err := newFileStore(root).RemoveTempFiles(); err != nil {
+		t.Fatalf("RemoveTempFiles - %v", err)
+	}
+}
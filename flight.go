@@ -0,0 +1,46 @@
+package main
+
+import "sync"
+
+// flightGroup coalesces concurrent calls with the same key into a single call,
+// whose result is shared by all the callers
+type flightGroup struct {
+	lock    sync.Mutex
+	flights map[string]*flight
+}
+
+// flight is a call in progress, or completed, for a key
+type flight struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+// newFlightGroup returns an empty flightGroup
+func newFlightGroup() *flightGroup {
+	return &flightGroup{flights: map[string]*flight{}}
+}
+
+// do calls fn, unless a call for the key is already in progress, in which case
+// its result is awaited instead.  shared is true if the result was from another call.
+func (g *flightGroup) do(key string, fn func() (interface{}, error)) (value interface{}, shared bool, err error) {
+	g.lock.Lock()
+	if f, ok := g.flights[key]; ok {
+		g.lock.Unlock()
+		<-f.done
+		return f.value, true, f.err
+	}
+	f := &flight{done: make(chan struct{})}
+	g.flights[key] = f
+	g.lock.Unlock()
+
+	defer func() {
+		g.lock.Lock()
+		delete(g.flights, key)
+		g.lock.Unlock()
+		close(f.done)
+	}()
+
+	f.value, f.err = fn()
+	return f.value, false, f.err
+}
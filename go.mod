@@ -1,10 +1,16 @@
 module github.com/gford1000-go/dataproxy
 
-go 1.14
+go 1.22
 
 require (
 	github.com/gford1000-go/logger v0.0.0-20211126171413-4d0371483e40
 	github.com/google/uuid v1.3.0
-	github.com/pierrec/lz4 v2.6.1+incompatible // indirect
-	github.com/pierrec/lz4/v4 v4.1.13 // indirect
+	github.com/klauspost/compress v1.18.0
+	github.com/pierrec/lz4 v2.6.1+incompatible
+	go.etcd.io/bbolt v1.3.10
+)
+
+require (
+	github.com/frankban/quicktest v1.14.6 // indirect
+	golang.org/x/sys v0.4.0 // indirect
 )
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gford1000-go/logger"
+	"github.com/google/uuid"
+)
+
+// checkpointKey is the reserved key under which the checkpoint of an ingest in
+// progress is held in the PageStore, alongside the pages of its dataset
+const checkpointKey = "ingest.json"
+
+// checkpointInterval is the minimum time between saves of a checkpoint
+const checkpointInterval = time.Second
+
+// ingestCheckpoint records how far the ingest of a CSV file has progressed, so
+// that an ingest interrupted by the process stopping can be resumed from the
+// last page before which all pages had been written.
+//
+// Page tokens are derived from a random seed, rather than each being random,
+// so that the resumed ingest produces the same chain of tokens; pages written
+// beyond the checkpoint are rewritten with the same tokens.
+type ingestCheckpoint struct {
+	Request   ExistingRequest `json:"request"`
+	FileName  string          `json:"file_name"`
+	Size      int64           `json:"size"`
+	Modified  int64           `json:"modified"`
+	TokenSeed string          `json:"token_seed"`
+	// Pages is the number of pages, from the first, that have all been written,
+	// the last of which has LastToken
+	Pages     int    `json:"pages"`
+	LastToken string `json:"last_token,omitempty"`
+	// Offset is the byte offset in the file of the first record of the next page,
+	// which has NextToken
+	Offset    int64  `json:"offset"`
+	NextToken string `json:"next_token"`
+}
+
+// newIngestCheckpoint returns the checkpoint of an ingest of the file that is yet to start
+func newIngestCheckpoint(req *ExistingRequest, stat os.FileInfo) *ingestCheckpoint {
+	fileName, err := filepath.Abs(req.CSVFileName)
+	if err != nil {
+		fileName = req.CSVFileName
+	}
+
+	c := &ingestCheckpoint{
+		Request:   *req,
+		FileName:  fileName,
+		Size:      stat.Size(),
+		Modified:  stat.ModTime().UnixNano(),
+		TokenSeed: NewUUID(),
+	}
+	c.NextToken = c.token(0)
+	return c
+}
+
+// token returns the token of the page at the position in the dataset
+func (c *ingestCheckpoint) token(seq int) string {
+	seed, err := uuid.Parse(c.TokenSeed)
+	if err != nil {
+		return NewUUID()
+	}
+	return uuid.NewSHA1(seed, []byte(strconv.Itoa(seq))).String()
+}
+
+// tokens returns the tokens of the first n pages of the dataset
+func (c *ingestCheckpoint) tokens(n int) []string {
+	tokens := make([]string, n)
+	for i := range tokens {
+		tokens[i] = c.token(i)
+	}
+	return tokens
+}
+
+// matches returns true if the file is the version of the file being ingested
+func (c *ingestCheckpoint) matches(stat os.FileInfo) bool {
+	return stat.Size() == c.Size && stat.ModTime().UnixNano() == c.Modified
+}
+
+// saveCheckpoint persists the checkpoint of the dataset's ingest
+func (c *cacheConfig) saveCheckpoint(hash string, cp *ingestCheckpoint) error {
+	b, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	return c.store.Put(hash, checkpointKey, b)
+}
+
+// loadCheckpoint returns the checkpoint of the dataset's ingest, or nil if there is none
+func (c *cacheConfig) loadCheckpoint(hash string) (*ingestCheckpoint, error) {
+	b, err := c.store.Get(hash, checkpointKey)
+	if err == errPageNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cp := &ingestCheckpoint{}
+	if err := json.Unmarshal(b, cp); err != nil {
+		return nil, err
+	}
+	return cp, nil
+}
+
+// resumeIngests resumes the ingests that were interrupted when the process last
+// stopped.  Ingests that cannot be resumed, because their file has changed or
+// is missing, are recorded as failed jobs and their datasets removed.
+func (c *cacheConfig) resumeIngests() {
+	log := logger.GetLogger()
+
+	hashes, err := c.store.Datasets()
+	if err != nil {
+		log(logger.Error, "", "Error listing datasets to resume ingests - %v", err)
+		return
+	}
+
+	for _, hash := range hashes {
+		cp, err := c.loadCheckpoint(hash)
+		if err != nil {
+			log(logger.Error, "", "Error loading ingest checkpoint of %v - %v", hash, err)
+			c.abandonIngest(hash, err)
+			continue
+		}
+		if cp == nil {
+			continue
+		}
+
+		if err := c.resumeIngest(hash, cp); err != nil {
+			log(logger.Error, "", "Unable to resume ingest of %v - %v", hash, err)
+			c.abandonIngest(hash, err)
+			continue
+		}
+		log(logger.Info, "", "Resumed ingest of %v from page %v", hash, cp.Pages)
+	}
+}
+
+// resumeIngest restarts the ingest of the dataset from its checkpoint
+func (c *cacheConfig) resumeIngest(hash string, cp *ingestCheckpoint) error {
+	info, err := c.datasets.get(hash)
+	if err != nil {
+		return err
+	}
+	if info == nil {
+		return fmt.Errorf("dataset has no metadata")
+	}
+
+	file, err := os.Open(cp.FileName)
+	if err != nil {
+		return err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if !cp.matches(stat) {
+		file.Close()
+		return fmt.Errorf("%v has changed since the ingest started", cp.FileName)
+	}
+
+	m := &existingFileRequestHandler{}
+	m.config = c
+	m.requestID = NewUUID()
+	if m.codec, err = codecByName(cp.Request.Codec); err != nil {
+		file.Close()
+		return err
+	}
+
+	// Only the pages still to be written are reserved, as the bytes of those
+	// already written are not known
+	if err := c.quota.reserve(hash, stat.Size()-cp.Offset); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := m.startIngest(hash, cp, file); err != nil {
+		file.Close()
+		return err
+	}
+	return nil
+}
+
+// abandonIngest records the ingest of the dataset as failed, and removes the dataset
+func (c *cacheConfig) abandonIngest(hash string, err error) {
+	job := c.jobs.start(hash, "existing")
+	job.fail(err)
+	if _, err := c.datasets.remove(hash); err != nil {
+		logger.GetLogger()(logger.Error, "", "Error removing dataset %v - %v", hash, err)
+	}
+	job.finish()
+}
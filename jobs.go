@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// The states of jobs, both ingests and re-encryption
+const (
+	jobIdle     = "idle"
+	jobRunning  = "running"
+	jobComplete = "complete"
+	jobFailed   = "failed"
+	// jobCancelled is the state of an ingest that was stopped before it completed
+	jobCancelled = "cancelled"
+)
+
+// jobRetention is how long finished ingest jobs are remembered
+const jobRetention = time.Hour
+
+// errJobNotRunning is returned when a job that has finished is cancelled
+var errJobNotRunning = errors.New("job is not running")
+
+// errIngestRunning is returned when a dataset whose ingest is running would be removed
+var errIngestRunning = errors.New("dataset is being ingested")
+
+// ingestStatus reports the progress of the ingest creating a dataset
+type ingestStatus struct {
+	Hash      string    `json:"hash"`
+	Kind      string    `json:"kind"`
+	State     string    `json:"state"`
+	Started   time.Time `json:"started"`
+	Completed time.Time `json:"completed"`
+	Rows      int64     `json:"rows"`
+	Pages     int64     `json:"pages"`
+	// Ready is the number of pages, from the first, that have all been written
+	Ready int64  `json:"ready"`
+	Bytes int64  `json:"bytes"`
+	Error string `json:"error,omitempty"`
+}
+
+// ingestJob tracks the ingest creating a dataset.  The first error reported
+// fails the job, but later errors are not recorded.  The ingest stops when the
+// context of the job is cancelled.
+//
+// Pages whose tokens have been returned to clients, but which have not yet been
+// written, are pending, so that requests for them can wait rather than fail.
+type ingestJob struct {
+	lock    sync.Mutex
+	status  ingestStatus
+	ctx     context.Context
+	stop    context.CancelFunc
+	done    chan struct{}
+	pending map[string]chan struct{}
+}
+
+// addPending records that the page with the token is yet to be written
+func (j *ingestJob) addPending(token string) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if j.pending != nil {
+		j.pending[token] = make(chan struct{})
+	}
+}
+
+// pageReady releases the requests waiting for the page with the token
+func (j *ingestJob) pageReady(token string) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if c, ok := j.pending[token]; ok {
+		close(c)
+		delete(j.pending, token)
+	}
+}
+
+// pendingPage returns a channel that is closed once the page with the token has
+// been written, or the job has finished, or nil if the page is not pending
+func (j *ingestJob) pendingPage(token string) <-chan struct{} {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	return j.pending[token]
+}
+
+// context returns the context of the ingest, which is cancelled if the job is cancelled
+func (j *ingestJob) context() context.Context {
+	return j.ctx
+}
+
+// cancel stops the ingest, returning errJobNotRunning if it has already finished
+func (j *ingestJob) cancel() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if j.status.State != jobRunning {
+		return errJobNotRunning
+	}
+	j.stop()
+	return nil
+}
+
+// wait blocks until the job finishes, or ctx is done
+func (j *ingestJob) wait(ctx context.Context) error {
+	select {
+	case <-j.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Status returns a snapshot of the progress of the job
+func (j *ingestJob) Status() ingestStatus {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	return j.status
+}
+
+// update applies f to the status whilst locked
+func (j *ingestJob) update(f func(s *ingestStatus)) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	f(&j.status)
+}
+
+// addRows records rows read from the source of the dataset
+func (j *ingestJob) addRows(n int) {
+	j.update(func(s *ingestStatus) { s.Rows += int64(n) })
+}
+
+// pageWritten records a page saved to the store, of the specified bytes
+func (j *ingestJob) pageWritten(bytes int64) {
+	j.update(func(s *ingestStatus) {
+		s.Pages++
+		s.Bytes += bytes
+	})
+}
+
+// pagesReady records the number of pages, from the first, that have all been written
+func (j *ingestJob) pagesReady(n int) {
+	j.update(func(s *ingestStatus) { s.Ready = int64(n) })
+}
+
+// resumeFrom records the pages, and their rows, written before the job was
+// resumed, all of which are ready
+func (j *ingestJob) resumeFrom(pages, rows int) {
+	j.update(func(s *ingestStatus) {
+		s.Pages = int64(pages)
+		s.Ready = int64(pages)
+		s.Rows = int64(rows)
+	})
+}
+
+// fail records the error, if it is the first
+func (j *ingestJob) fail(err error) {
+	j.update(func(s *ingestStatus) {
+		if s.Error == "" {
+			s.Error = err.Error()
+		}
+	})
+}
+
+// failed returns true if an error has been recorded
+func (j *ingestJob) failed() bool {
+	return j.Status().Error != ""
+}
+
+// finish completes the job, as cancelled if it was cancelled, or otherwise
+// as failed if an error was recorded
+func (j *ingestJob) finish() {
+	j.update(func(s *ingestStatus) {
+		switch {
+		case j.ctx.Err() != nil:
+			s.State = jobCancelled
+		case s.Error != "":
+			s.State = jobFailed
+		default:
+			s.State = jobComplete
+		}
+		s.Completed = time.Now().UTC()
+
+		// Pages still pending will never be written
+		for _, c := range j.pending {
+			close(c)
+		}
+		j.pending = nil
+	})
+	j.stop()
+	close(j.done)
+}
+
+// stopped returns true if the job was cancelled or has failed, in which case
+// its dataset is incomplete
+func (j *ingestJob) stopped() bool {
+	return j.ctx.Err() != nil || j.failed()
+}
+
+// jobRegistry holds the ingest jobs of a cache, by the hash of their dataset
+type jobRegistry struct {
+	lock sync.Mutex
+	jobs map[string]*ingestJob
+	// removing holds the datasets being removed by removeIdle, which are closed once removed
+	removing map[string]chan struct{}
+}
+
+// newJobRegistry returns an empty jobRegistry
+func newJobRegistry() *jobRegistry {
+	return &jobRegistry{
+		jobs:     map[string]*ingestJob{},
+		removing: map[string]chan struct{}{},
+	}
+}
+
+// awaitRemoval waits for any removal of the dataset to finish; the caller must hold
+// the lock, which is released whilst waiting
+func (r *jobRegistry) awaitRemoval(hash string) {
+	for {
+		removed, ok := r.removing[hash]
+		if !ok {
+			return
+		}
+		r.lock.Unlock()
+		<-removed
+		r.lock.Lock()
+	}
+}
+
+// removeIdle calls remove for the dataset, unless its ingest is running, in which
+// case errIngestRunning is returned.  No job of the dataset starts until remove returns.
+func (r *jobRegistry) removeIdle(hash string, remove func(hash string) (int64, error)) (int64, error) {
+	r.lock.Lock()
+	r.awaitRemoval(hash)
+	if job, ok := r.jobs[hash]; ok && job.Status().State == jobRunning {
+		r.lock.Unlock()
+		return 0, errIngestRunning
+	}
+	removed := make(chan struct{})
+	r.removing[hash] = removed
+	r.lock.Unlock()
+
+	defer func() {
+		r.lock.Lock()
+		delete(r.removing, hash)
+		r.lock.Unlock()
+		close(removed)
+	}()
+
+	return remove(hash)
+}
+
+// start returns a running job for the dataset, replacing any earlier job, once
+// any removal of the dataset has finished.  Jobs that finished more than
+// jobRetention ago are forgotten.
+func (r *jobRegistry) start(hash, kind string) *ingestJob {
+	ctx, stop := context.WithCancel(context.Background())
+	job := &ingestJob{
+		status: ingestStatus{
+			Hash:    hash,
+			Kind:    kind,
+			State:   jobRunning,
+			Started: time.Now().UTC(),
+		},
+		ctx:     ctx,
+		stop:    stop,
+		done:    make(chan struct{}),
+		pending: map[string]chan struct{}{},
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.awaitRemoval(hash)
+	for h, j := range r.jobs {
+		if s := j.Status(); s.State != jobRunning && time.Since(s.Completed) > jobRetention {
+			delete(r.jobs, h)
+		}
+	}
+	r.jobs[hash] = job
+	return job
+}
+
+// get returns the job of the dataset, or nil if there is none
+func (r *jobRegistry) get(hash string) *ingestJob {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.jobs[hash]
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// jobsPattern is the path under which ingest jobs are identified by the hash of their dataset
+const jobsPattern = "/jobs/"
+
+// NewJobStatusHandlerFactory returns a factory instance that manufactures Handlers
+// which report the progress of the ingest creating a dataset.
+func NewJobStatusHandlerFactory() HandlerFactory {
+	return &jobStatusHandlerFactory{}
+}
+
+type jobStatusHandlerFactory struct {
+}
+
+func (f *jobStatusHandlerFactory) New(pattern string, config *cacheConfig, requestID string) Handler {
+	h := &jobStatusHandler{}
+	h.method = http.MethodGet
+	h.config = config
+	h.handler = h.handleJobStatus
+	h.pattern = pattern
+	h.requestID = requestID
+
+	return h
+}
+
+type jobStatusHandler struct {
+	baseHandler
+}
+
+// jobHash returns the hash identified by the path of a request to jobsPattern
+func jobHash(req *http.Request) (string, error) {
+	hash := strings.TrimPrefix(req.URL.Path, jobsPattern)
+	if err := validateHash(hash); err != nil {
+		return "", fmt.Errorf("invalid job: %v", hash)
+	}
+	return hash, nil
+}
+
+// handleJobStatus is invoked after the initial authorization and validation checks are completed,
+// and returns the status of the job identified by the path
+func (j *jobStatusHandler) handleJobStatus(w http.ResponseWriter, req *http.Request) {
+
+	hash, err := jobHash(req)
+	if err != nil {
+		returnError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	job := j.config.jobs.get(hash)
+	if job == nil {
+		returnError(w, fmt.Sprintf("no job for %v", hash), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(job.Status())
+}
+
+// NewJobCancelHandlerFactory returns a factory instance that manufactures Handlers
+// which cancel the ingest creating a dataset.
+func NewJobCancelHandlerFactory() HandlerFactory {
+	return &jobCancelHandlerFactory{}
+}
+
+type jobCancelHandlerFactory struct {
+}
+
+func (f *jobCancelHandlerFactory) New(pattern string, config *cacheConfig, requestID string) Handler {
+	h := &jobCancelHandler{}
+	h.method = http.MethodDelete
+	h.config = config
+	h.handler = h.handleJobCancel
+	h.pattern = pattern
+	h.requestID = requestID
+
+	return h
+}
+
+type jobCancelHandler struct {
+	baseHandler
+}
+
+// handleJobCancel is invoked after the initial authorization and validation checks are completed,
+// and cancels the job identified by the path.  The response is returned once the ingest
+// has stopped and the pages it wrote have been removed.
+func (j *jobCancelHandler) handleJobCancel(w http.ResponseWriter, req *http.Request) {
+
+	hash, err := jobHash(req)
+	if err != nil {
+		returnError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	job := j.config.jobs.get(hash)
+	if job == nil {
+		returnError(w, fmt.Sprintf("no job for %v", hash), http.StatusNotFound)
+		return
+	}
+
+	if err := job.cancel(); err != nil {
+		returnError(w, err.Error(), http.StatusConflict)
+		return
+	}
+	j.Info("Cancelled job %v", hash)
+
+	if err := job.wait(req.Context()); err != nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(job.Status())
+}
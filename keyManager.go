@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dataKeySize is the size of the AES key generated for each dataset
+const dataKeySize = 32
+
+// errDataKeyUnavailable is returned when the data key of a dataset does not
+// exist, for example because it has been destroyed
+var errDataKeyUnavailable = errors.New("dataset key unavailable")
+
+// KeyManager protects the data keys of datasets by wrapping them with a master key
+type KeyManager interface {
+	// WrapKey encrypts the data key, returning it with the ID of the master key used
+	WrapKey(dataKey []byte) (wrapped []byte, keyID string, err error)
+	// UnwrapKey decrypts a data key wrapped by the specified master key
+	UnwrapKey(wrapped []byte, keyID string) ([]byte, error)
+}
+
+// newKeyManager creates the KeyManager of the specified kind
+func newKeyManager(kind, url string, keys *keyring) (KeyManager, error) {
+	switch strings.ToLower(kind) {
+	case "local":
+		if _, block := keys.activeKey(); block == nil {
+			return nil, fmt.Errorf("local key manager requires a master key")
+		}
+		return &localKeyManager{keys: keys}, nil
+	case "http":
+		if url == "" {
+			return nil, fmt.Errorf("http key manager requires a URL")
+		}
+		return &httpKeyManager{url: strings.TrimRight(url, "/"), client: &http.Client{Timeout: 10 * time.Second}}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key manager: %v", kind)
+	}
+}
+
+// localKeyManager wraps data keys with the master keys of a keyring,
+// loaded from the -key and -keys flags
+type localKeyManager struct {
+	keys *keyring
+}
+
+func (l *localKeyManager) WrapKey(dataKey []byte) ([]byte, string, error) {
+	keyID, block := l.keys.activeKey()
+	if block == nil {
+		return nil, "", errKeyNotFound
+	}
+	wrapped, err := seal(block, dataKey, nil)
+	return wrapped, keyID, err
+}
+
+func (l *localKeyManager) UnwrapKey(wrapped []byte, keyID string) ([]byte, error) {
+	block, err := l.keys.key(keyID)
+	if err != nil {
+		return nil, err
+	}
+	return unseal(block, wrapped, nil)
+}
+
+// kmsWrapRequest and kmsWrapResponse are the messages exchanged with a remote key manager
+type kmsWrapRequest struct {
+	Key   []byte `json:"key,omitempty"`
+	KeyID string `json:"key_id,omitempty"`
+}
+
+type kmsWrapResponse struct {
+	Key   []byte `json:"key"`
+	KeyID string `json:"key_id"`
+}
+
+// httpKeyManager delegates wrapping of data keys to a remote service, which
+// accepts POST requests to /wrap and /unwrap
+type httpKeyManager struct {
+	url    string
+	client *http.Client
+}
+
+func (h *httpKeyManager) WrapKey(dataKey []byte) ([]byte, string, error) {
+	resp, err := h.call("/wrap", &kmsWrapRequest{Key: dataKey})
+	if err != nil {
+		return nil, "", err
+	}
+	return resp.Key, resp.KeyID, nil
+}
+
+func (h *httpKeyManager) UnwrapKey(wrapped []byte, keyID string) ([]byte, error) {
+	resp, err := h.call("/unwrap", &kmsWrapRequest{Key: wrapped, KeyID: keyID})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Key, nil
+}
+
+// call sends the request to the remote service
+func (h *httpKeyManager) call(path string, req *kmsWrapRequest) (*kmsWrapResponse, error) {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := h.client.Post(h.url+path, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("key manager request failed with status %v: %s", resp.StatusCode, msg)
+	}
+
+	var result kmsWrapResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// kmsStandIn is an in-process stand-in for a remote key manager, serving
+// the requests of httpKeyManager using its own KeyManager
+type kmsStandIn struct {
+	keys KeyManager
+}
+
+// startKMSStandIn starts a kmsStandIn listening on a local port, returning its URL
+func startKMSStandIn(keys KeyManager) (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+
+	go http.Serve(l, &kmsStandIn{keys: keys})
+
+	return fmt.Sprintf("http://%v", l.Addr()), nil
+}
+
+func (k *kmsStandIn) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		returnError(w, "Only POST methods are accepted", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var r kmsWrapRequest
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		returnError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var resp kmsWrapResponse
+	var err error
+	switch req.URL.Path {
+	case "/wrap":
+		resp.Key, resp.KeyID, err = k.keys.WrapKey(r.Key)
+	case "/unwrap":
+		resp.Key, err = k.keys.UnwrapKey(r.Key, r.KeyID)
+		resp.KeyID = r.KeyID
+	default:
+		returnError(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		returnError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// dataKeys manages the data keys of datasets, which are generated when the
+// dataset is created and held, wrapped by the KeyManager, in its metadata.
+// Datasets whose keys are destroyed are remembered, so that a key being
+// unwrapped when it is destroyed is not then cached.
+type dataKeys struct {
+	kms       KeyManager
+	registry  *datasetRegistry
+	lock      sync.Mutex
+	blocks    map[string]cipher.Block
+	destroyed map[string]bool
+}
+
+// newDataKeys returns a dataKeys for the datasets of the registry
+func newDataKeys(kms KeyManager, registry *datasetRegistry) *dataKeys {
+	d := &dataKeys{
+		kms:       kms,
+		registry:  registry,
+		blocks:    map[string]cipher.Block{},
+		destroyed: map[string]bool{},
+	}
+	registry.notifyRemove(d.forget)
+	return d
+}
+
+// create generates a data key for the new dataset, adding it in wrapped form to the metadata
+func (d *dataKeys) create(info *datasetInfo) error {
+	key := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return err
+	}
+
+	wrapped, keyID, err := d.kms.WrapKey(key)
+	if err != nil {
+		return err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+
+	info.DataKey = wrapped
+	info.DataKeyID = keyID
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.blocks[info.Hash] = block
+	delete(d.destroyed, info.Hash)
+	return nil
+}
+
+// block returns the cipher of the data key of the dataset
+func (d *dataKeys) block(hash string) (cipher.Block, error) {
+	d.lock.Lock()
+	block, ok := d.blocks[hash]
+	destroyed := d.destroyed[hash]
+	d.lock.Unlock()
+	if ok {
+		return block, nil
+	}
+	if destroyed {
+		return nil, errDataKeyUnavailable
+	}
+
+	info, err := d.registry.get(hash)
+	if err != nil {
+		return nil, err
+	}
+	if info == nil || len(info.DataKey) == 0 {
+		return nil, errDataKeyUnavailable
+	}
+
+	key, err := d.kms.UnwrapKey(info.DataKey, info.DataKeyID)
+	if err != nil {
+		return nil, err
+	}
+	block, err = aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.destroyed[hash] {
+		return nil, errDataKeyUnavailable
+	}
+	d.blocks[hash] = block
+	return block, nil
+}
+
+// rewrap wraps the data key of the dataset with the current master key of the
+// KeyManager, returning true if the dataset has a data key.  The metadata is updated
+// whilst the key is re-wrapped, so that a key destroyed meanwhile is not restored.
+func (d *dataKeys) rewrap(hash string) (bool, error) {
+	found := false
+	var wrapErr error
+	_, err := d.registry.update(hash, func(info *datasetInfo) bool {
+		if len(info.DataKey) == 0 {
+			return false
+		}
+		found = true
+
+		key, err := d.kms.UnwrapKey(info.DataKey, info.DataKeyID)
+		if err != nil {
+			wrapErr = err
+			return false
+		}
+		info.DataKey, info.DataKeyID, wrapErr = d.kms.WrapKey(key)
+		return wrapErr == nil
+	})
+	if wrapErr != nil {
+		return found, wrapErr
+	}
+	return found, err
+}
+
+// destroy removes the data key of the dataset, so that its pages can no longer be
+// decrypted.  Stores that retain replaced metadata are compacted, so that the
+// wrapped key is not left in the store.
+func (d *dataKeys) destroy(hash string) error {
+	saved, err := d.registry.update(hash, func(info *datasetInfo) bool {
+		if len(info.DataKey) == 0 {
+			return false
+		}
+
+		d.lock.Lock()
+		d.destroyed[hash] = true
+		delete(d.blocks, hash)
+		d.lock.Unlock()
+
+		info.DataKey = nil
+		info.DataKeyID = ""
+		return true
+	})
+	if err != nil {
+		// The key remains usable if its removal could not be saved
+		if saved {
+			d.lock.Lock()
+			delete(d.destroyed, hash)
+			d.lock.Unlock()
+		}
+		return err
+	}
+	if !saved {
+		return errDataKeyUnavailable
+	}
+
+	if c, ok := d.registry.store.(datasetCompactor); ok {
+		if _, err := c.Compact(hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forget discards the cached cipher of the dataset
+func (d *dataKeys) forget(hash string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	delete(d.blocks, hash)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"testing"
+)
+
+// newStandInKeyManager returns an httpKeyManager using a kmsStandIn, whose master
+// keys are held by the keyring
+func newStandInKeyManager(t *testing.T, keys *keyring) KeyManager {
+	t.Helper()
+
+	url, err := startKMSStandIn(&localKeyManager{keys: keys})
+	if err != nil {
+		t.Fatalf("Error starting stand-in - %v", err)
+	}
+	km, err := newKeyManager("http", url, keys)
+	if err != nil {
+		t.Fatalf("Error creating key manager - %v", err)
+	}
+	return km
+}
+
+func TestKMSStandInWrapUnwrap(t *testing.T) {
+	keys := newKeyring()
+	if err := keys.add("k1", []byte("0123456789abcdef")); err != nil {
+		t.Fatalf("Error adding key - %v", err)
+	}
+	km := newStandInKeyManager(t, keys)
+
+	dataKey := []byte("0123456789abcdef0123456789abcdef")
+	wrapped, keyID, err := km.WrapKey(dataKey)
+	if err != nil {
+		t.Fatalf("WrapKey - %v", err)
+	}
+	if keyID != "k1" {
+		t.Fatalf("WrapKey used key %v, expected k1", keyID)
+	}
+	if bytes.Contains(wrapped, dataKey) {
+		t.Fatal("WrapKey returned the data key in plain text")
+	}
+
+	unwrapped, err := km.UnwrapKey(wrapped, keyID)
+	if err != nil {
+		t.Fatalf("UnwrapKey - %v", err)
+	}
+	if !bytes.Equal(unwrapped, dataKey) {
+		t.Fatalf("UnwrapKey returned %x, expected %x", unwrapped, dataKey)
+	}
+
+	tampered := append([]byte{}, wrapped...)
+	tampered[len(tampered)-1] ^= 0xff
+	if _, err := km.UnwrapKey(tampered, keyID); err == nil {
+		t.Fatal("UnwrapKey of a tampered key succeeded")
+	}
+	if _, err := km.UnwrapKey(wrapped, "k2"); err == nil {
+		t.Fatal("UnwrapKey with an unknown master key succeeded")
+	}
+}
+
+func TestKMSStandInRotation(t *testing.T) {
+	keys := newKeyring()
+	if err := keys.add("k1", []byte("0123456789abcdef")); err != nil {
+		t.Fatalf("Error adding key - %v", err)
+	}
+	km := newStandInKeyManager(t, keys)
+
+	dataKey := []byte("0123456789abcdef0123456789abcdef")
+	wrapped, keyID, err := km.WrapKey(dataKey)
+	if err != nil {
+		t.Fatalf("WrapKey - %v", err)
+	}
+
+	// Keys wrapped by earlier master keys remain available after rotation
+	if err := keys.add("k2", []byte("fedcba9876543210")); err != nil {
+		t.Fatalf("Error adding key - %v", err)
+	}
+	if err := keys.setActive("k2"); err != nil {
+		t.Fatalf("Error activating key - %v", err)
+	}
+	if _, rotated, err := km.WrapKey(dataKey); err != nil || rotated != "k2" {
+		t.Fatalf("WrapKey after rotation used key %v - %v, expected k2", rotated, err)
+	}
+	unwrapped, err := km.UnwrapKey(wrapped, keyID)
+	if err != nil || !bytes.Equal(unwrapped, dataKey) {
+		t.Fatalf("UnwrapKey after rotation - %v", err)
+	}
+}
+
+func TestShredMakesPagesUnreadable(t *testing.T) {
+	for _, kind := range []string{"file", "pack"} {
+		t.Run(kind, func(t *testing.T) {
+			root := t.TempDir()
+			config := newTestCacheConfig(t, cacheOptions{
+				storeKind:  kind,
+				store:      storeOptions{root: root},
+				key:        "0123456789abcdef",
+				kms:        "http",
+				kmsStandIn: true,
+			})
+
+			m := &writeHandler{baseHandler: baseHandler{config: config, requestID: "test"}}
+			hash, token := "shred", NewUUID()
+			if err := m.createDataset(&datasetInfo{Hash: hash, Tokens: []string{token}}, 0, 0); err != nil {
+				t.Fatalf("createDataset - %v", err)
+			}
+			cols := []Column{{Name: "a", Type: "string"}}
+			if err := m.createPage(context.Background(), hash, token, "", cols, [][]string{{"secret"}}); err != nil {
+				t.Fatalf("createPage - %v", err)
+			}
+			if err := m.completeDataset(hash, nil, 1); err != nil {
+				t.Fatalf("completeDataset - %v", err)
+			}
+
+			// The metadata holds the wrapped key in base64
+			info, _ := config.datasets.get(hash)
+			wrapped := []byte(base64.StdEncoding.EncodeToString(info.DataKey))
+
+			read := func() error {
+				_, err := m.retrievePage(&pageInfo{hash: hash, token: token, types: []string{pageContentType}})
+				return err
+			}
+			if err := read(); err != nil {
+				t.Fatalf("retrievePage before shred - %v", err)
+			}
+
+			if err := config.dataKeys.destroy(hash); err != nil {
+				t.Fatalf("destroy - %v", err)
+			}
+			if err := read(); err == nil {
+				t.Fatal("retrievePage after shred succeeded")
+			}
+			if err := config.dataKeys.destroy(hash); err != errDataKeyUnavailable {
+				t.Fatalf("second destroy returned %v, expected errDataKeyUnavailable", err)
+			}
+
+			// The wrapped key must not remain anywhere in the store
+			files, err := ioutil.ReadDir(fmt.Sprintf("%v/%v", root, hash))
+			if err != nil {
+				t.Fatalf("Error reading dataset folder - %v", err)
+			}
+			for _, f := range files {
+				b, err := ioutil.ReadFile(fmt.Sprintf("%v/%v/%v", root, hash, f.Name()))
+				if err != nil {
+					t.Fatalf("Error reading %v - %v", f.Name(), err)
+				}
+				if bytes.Contains(b, wrapped) {
+					t.Fatalf("%v still holds the wrapped data key", f.Name())
+				}
+			}
+		})
+	}
+}
+
+func TestDestroyedKeyIsNotCached(t *testing.T) {
+	keys := newKeyring()
+	if err := keys.add("k1", []byte("0123456789abcdef")); err != nil {
+		t.Fatalf("Error adding key - %v", err)
+	}
+	registry := newDatasetRegistry(newMemoryStore(1 << 20))
+	d := newDataKeys(&localKeyManager{keys: keys}, registry)
+
+	info := &datasetInfo{Hash: "h1"}
+	if err := d.create(info); err != nil {
+		t.Fatalf("create - %v", err)
+	}
+	if err := registry.save(info); err != nil {
+		t.Fatalf("save - %v", err)
+	}
+	if err := d.destroy("h1"); err != nil {
+		t.Fatalf("destroy - %v", err)
+	}
+	if _, err := d.block("h1"); err != errDataKeyUnavailable {
+		t.Fatalf("block after destroy returned %v, expected errDataKeyUnavailable", err)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+)
+
+// legacyKeyID is the ID of the key supplied by the -key flag, which is
+// also the key used for pages written without an envelope
+const legacyKeyID = "default"
+
+// errKeyNotFound is returned when a page is sealed by a key that is not in the keyring
+var errKeyNotFound = errors.New("key not found")
+
+// keyringFile is the format of the file from which keys are loaded
+type keyringFile struct {
+	Active string `json:"active"`
+	Keys   []struct {
+		ID  string `json:"id"`
+		Key string `json:"key"`
+	} `json:"keys"`
+}
+
+// keyring holds the AES keys that pages may be sealed with, identified by ID.
+// New pages are sealed with the active key.
+type keyring struct {
+	lock   sync.RWMutex
+	keys   map[string]cipher.Block
+	active string
+}
+
+// newKeyring returns an empty keyring, with which pages are not encrypted
+func newKeyring() *keyring {
+	return &keyring{keys: map[string]cipher.Block{}}
+}
+
+// add creates a cipher for the key, making it the active key if there is none
+func (k *keyring) add(id string, key []byte) error {
+	if id == "" || len(id) > 255 {
+		return fmt.Errorf("invalid key ID: %q", id)
+	}
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	k.keys[id] = c
+	if k.active == "" {
+		k.active = id
+	}
+	return nil
+}
+
+// load adds the keys held in the file, making its active key the active key of the keyring
+func (k *keyring) load(fileName string) error {
+	b, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+
+	var f keyringFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return err
+	}
+
+	for _, key := range f.Keys {
+		if err := k.add(key.ID, []byte(key.Key)); err != nil {
+			return fmt.Errorf("key %v - %v", key.ID, err)
+		}
+	}
+
+	if f.Active != "" {
+		return k.setActive(f.Active)
+	}
+	return nil
+}
+
+// setActive changes the key used to seal new pages
+func (k *keyring) setActive(id string) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if _, ok := k.keys[id]; !ok {
+		return errKeyNotFound
+	}
+	k.active = id
+	return nil
+}
+
+// activeKey returns the key with which new pages are sealed, or nil
+// if the keyring is empty and pages are not to be encrypted
+func (k *keyring) activeKey() (string, cipher.Block) {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+
+	return k.active, k.keys[k.active]
+}
+
+// key returns the key with the specified ID
+func (k *keyring) key(id string) (cipher.Block, error) {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+
+	if c, ok := k.keys[id]; ok {
+		return c, nil
+	}
+	return nil, errKeyNotFound
+}
+
+// ids returns the IDs of all keys in the keyring
+func (k *keyring) ids() []string {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+
+	ids := []string{}
+	for id := range k.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// seal encrypts the data with AES-GCM, authenticating the additional data,
+// and prefixing the result with the random nonce
+func seal(block cipher.Block, data, aad []byte) ([]byte, error) {
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, data, aad), nil
+}
+
+// unseal decrypts data created by seal with the same additional data
+func unseal(block cipher.Block, sealed, aad []byte) ([]byte, error) {
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonceSize := gcm.NonceSize()
+	if len(sealed) < nonceSize {
+		return nil, errors.New("sealed data is too short")
+	}
+
+	nonce, data := sealed[:nonceSize], sealed[nonceSize:]
+	return gcm.Open(nil, nonce, data, aad)
+}
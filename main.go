@@ -1,14 +1,16 @@
 package main
 
 import (
-	"crypto/aes"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"runtime"
 	"runtime/pprof"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/gford1000-go/logger"
 )
@@ -27,8 +29,8 @@ type HandlerFactory interface {
 	New(pattern string, config *cacheConfig, requestID string) Handler
 }
 
-// postHandler creates a request handler that ensures consistent authorization and validation behaviour for POST requests
-func postHandler(pattern string, config *cacheConfig, factory HandlerFactory) func(w http.ResponseWriter, req *http.Request) {
+// requestHandler creates a request handler that ensures consistent authorization and validation behaviour for requests
+func requestHandler(pattern string, config *cacheConfig, factory HandlerFactory) func(w http.ResponseWriter, req *http.Request) {
 
 	return func(w http.ResponseWriter, req *http.Request) {
 		// Create a new handler instance for each request, with a unique identifier
@@ -37,14 +39,26 @@ func postHandler(pattern string, config *cacheConfig, factory HandlerFactory) fu
 	}
 }
 
+// methodHandler dispatches requests to the handler for the request method
+func methodHandler(handlers map[string]func(w http.ResponseWriter, req *http.Request)) func(w http.ResponseWriter, req *http.Request) {
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if h, ok := handlers[req.Method]; ok {
+			h(w, req)
+			return
+		}
+		returnError(w, fmt.Sprintf("Method %v is not accepted", req.Method), http.StatusMethodNotAllowed)
+	}
+}
+
 // alive verifies the server is running
 func alive(w http.ResponseWriter, req *http.Request) {
 	fmt.Fprintf(w, "up\n")
 }
 
 // setupCloseHandler captures CTRL-C events
-func setupCloseHandler(isCpuProfiling bool) {
-	c := make(chan os.Signal)
+func setupCloseHandler(isCpuProfiling bool, config *serverConfig) {
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
@@ -54,6 +68,11 @@ func setupCloseHandler(isCpuProfiling bool) {
 			pprof.StopCPUProfile()
 		}
 
+		if config.cache.tenants != nil {
+			config.cache.tenants.close()
+		}
+		config.cache.close()
+
 		os.Exit(0)
 	}()
 }
@@ -63,14 +82,53 @@ func main() {
 	port := flag.Int("port", 8080, "Port on which to listen")
 	root := flag.String("cache", "/tmp", "Location of cache")
 	encryptionKey := flag.String("key", "", "AES key for cache")
+	keysFile := flag.String("keys", "", "File of AES keys for cache, identified by ID, one of which is active")
 	salt := flag.String("salt", "", "Salt for cache filenames")
 	logName := flag.String("log", "/tmp/dataproxy.log", "Log file name")
-	useCompression := flag.Bool("zip", false, "If present, then cache files are compressed prior to saving")
+	useCompression := flag.Bool("zip", false, "If present, then cache files are compressed prior to saving, with lz4 unless -codec is specified")
+	codecName := flag.String("codec", "", fmt.Sprintf("Codec with which cache files are compressed (%v)", strings.Join(codecNames(), ", ")))
+	compressionLevel := flag.Int("zip-level", 0, "Compression level for codecs that support it (zstd, gzip); zero is the codec default")
+	transcode := flag.Bool("transcode", false, "If present, then pages are recompressed with a codec the client accepts, when the stored codec is not accepted")
+	streamPages := flag.Bool("stream", true, "If true, then pages held in local files (file and pack stores) are streamed from the file rather than read into memory")
+	ingestWorkers := flag.Int("ingest-workers", runtime.NumCPU(), "Number of pages of a CSV ingest written concurrently; reading the CSV waits whilst all are busy")
+	benchCodecs := flag.String("bench-codecs", "", "If present, then the CSV file is compressed with each codec and the results reported, instead of starting the server")
+	benchRecords := flag.Int("bench-records", 10000, "Records per page used by -bench-codecs")
+	benchServe := flag.Int("bench-serve", 0, "If positive, then pages of this many records are served buffered and streamed, and the memory used reported, instead of starting the server")
+	benchPages := flag.Int("bench-pages", 200, "Pages served by -bench-serve")
+	benchIngest := flag.String("bench-ingest", "", "If present, then the CSV file is ingested with 1, -ingest-workers and 1024 page writers, and the peak memory reported, instead of starting the server")
 	cpuprofile := flag.String("cpuprofile", "", "Write cpu profile to specified file")
 	maxPageHandlers := flag.Int("page", 5, "Max number of concurrent page handlers")
+	storeKind := flag.String("store", "file", "Page store to use (file, pack, bolt, s3, memory, tiered)")
+	memoryBudget := flag.Int64("memory", 256<<20, "Byte budget for pages held in memory")
+	tierPolicy := flag.String("tier-policy", writeThrough, "Tiered store write policy (writethrough, writeback)")
+	promoteAfter := flag.Int("promote", 1, "Number of disk reads before a page is promoted to memory by the tiered store")
+	packConvert := flag.Bool("pack-convert", false, "If present, then existing per-file datasets are converted on startup by the pack store")
+	s3Endpoint := flag.String("s3-endpoint", "", "Endpoint URL of the S3 compatible service used by the s3 store")
+	s3Bucket := flag.String("s3-bucket", "dataproxy", "Bucket used by the s3 store")
+	s3Region := flag.String("s3-region", "us-east-1", "Region used to sign requests to the S3 compatible service")
+	s3AccessKey := flag.String("s3-access-key", "", "Access key for the S3 compatible service")
+	s3SecretKey := flag.String("s3-secret-key", "", "Secret key for the S3 compatible service")
+	s3Fake := flag.Bool("s3-fake", false, "If present, then the s3 store uses an in-process stand-in for the S3 compatible service")
+	ttl := flag.Duration("ttl", 0, "Default lifetime of datasets, after which they expire; zero means never")
+	gcInterval := flag.Duration("gc-interval", 10*time.Minute, "Interval between sweeps that remove expired datasets")
+	kms := flag.String("kms", "", "Key manager wrapping per-dataset data keys (local, http); if absent pages are sealed directly by the active key")
+	kmsURL := flag.String("kms-url", "", "URL of the remote key manager used by the http key manager")
+	kmsStandIn := flag.Bool("kms-standin", false, "If present, then the http key manager uses an in-process stand-in holding the keys of -key and -keys")
+	quota := flag.Int64("quota", 0, "Maximum bytes of cache storage used by datasets; zero means unlimited")
+	evictPolicy := flag.String("evict", evictLRU, "Dataset eviction policy when the quota is reached (lru, lfu, oldest)")
+	tenantsFile := flag.String("tenants", "", "File defining tenants, each with their own credentials, keys and cache; if absent requests are not authenticated")
+	packCompact := flag.Bool("pack-compact", false, "If present, then dataset segments are compacted on startup by the pack store")
 
 	flag.Parse()
 
+	if *benchCodecs != "" {
+		if err := benchmarkCodecs(os.Stdout, *benchCodecs, *benchRecords, *compressionLevel); err != nil {
+			fmt.Fprintf(os.Stderr, "Benchmark failed - %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Set up CPU profiling per https://go.dev/blog/pprof
 	// using CTRL-C capture as the way to capture the profile,
 	// since ListenAndServe() will not exit
@@ -82,33 +140,110 @@ func main() {
 		pprof.StartCPUProfile(f)
 	}
 
-	setupCloseHandler(*cpuprofile != "")
+	log, _ := logger.NewFileLogger(*logName, logger.All, "DataProxy ")
+
+	if *benchIngest != "" {
+		workers := []int{1, *ingestWorkers, 1024}
+		if err := benchmarkIngest(os.Stdout, *benchIngest, *benchRecords, workers); err != nil {
+			fmt.Fprintf(os.Stderr, "Benchmark failed - %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *benchServe > 0 {
+		if err := benchmarkServing(os.Stdout, *benchServe, *benchPages, *maxPageHandlers); err != nil {
+			fmt.Fprintf(os.Stderr, "Benchmark failed - %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	opts := &cacheOptions{
+		storeKind: *storeKind,
+		store: storeOptions{
+			root:         *root,
+			memoryBudget: *memoryBudget,
+			tierPolicy:   *tierPolicy,
+			promoteAfter: *promoteAfter,
+			s3: s3Config{
+				endpoint:  *s3Endpoint,
+				bucket:    *s3Bucket,
+				region:    *s3Region,
+				accessKey: *s3AccessKey,
+				secretKey: *s3SecretKey,
+			},
+		},
+		salt:             *salt,
+		key:              *encryptionKey,
+		keysFile:         *keysFile,
+		useCompression:   *useCompression,
+		codec:            *codecName,
+		compressionLevel: *compressionLevel,
+		transcode:        *transcode,
+		streamPages:      *streamPages,
+		ingestWorkers:    *ingestWorkers,
+		defaultTTL:       *ttl,
+		gcInterval:       *gcInterval,
+		quota:            *quota,
+		evictPolicy:      *evictPolicy,
+		kms:              *kms,
+		kmsURL:           *kmsURL,
+		kmsStandIn:       *kmsStandIn,
+		packConvert:      *packConvert,
+		packCompact:      *packCompact,
+	}
+
+	if *s3Fake {
+		endpoint, err := startS3Fake(opts.store.s3)
+		if err != nil {
+			panic(fmt.Sprintf("Error starting S3 stand-in - %v", err))
+		}
+		opts.store.s3.endpoint = endpoint
+	}
 
 	config := &serverConfig{
 		port: *port,
 		log:  *logName,
-		cache: &cacheConfig{
-			root:           *root,
-			salt:           []byte(*salt),
-			useCompression: *useCompression,
-		},
 	}
 
-	key := []byte(*encryptionKey)
-	if len(key) > 0 {
-		c, err := aes.NewCipher(key)
+	// With tenants, each request is processed using the cache of its tenant
+	if *tenantsFile != "" {
+		tenants, err := loadTenants(*tenantsFile, opts)
 		if err != nil {
-			panic(fmt.Sprintf("Error creating Cipher - %v", err))
+			panic(fmt.Sprintf("Error loading tenants - %v", err))
 		}
-		config.cache.cipher = c
+		config.cache = &cacheConfig{tenants: tenants}
+	} else {
+		cache, err := newCacheConfig(opts)
+		if err != nil {
+			panic(fmt.Sprintf("Error creating cache - %v", err))
+		}
+		config.cache = cache
 	}
 
-	log, _ := logger.NewFileLogger(config.log, logger.All, "DataProxy ")
+	setupCloseHandler(*cpuprofile != "", config)
+
 	log(logger.Info, "", "Starting on port %v", config.port)
 
 	http.HandleFunc("/alive", alive)
-	http.HandleFunc("/page", postHandler("/page", config.cache, NewPageRequestHandlerFactory(*maxPageHandlers)))
-	http.HandleFunc("/create", postHandler("/create", config.cache, NewMockCreatRequestHandlerFactory()))
-	http.HandleFunc("/existing", postHandler("/existing", config.cache, NewExistingRequestHandlerFactory()))
+	http.HandleFunc("/page", requestHandler("/page", config.cache, NewPageRequestHandlerFactory(*maxPageHandlers)))
+	http.HandleFunc("/create", requestHandler("/create", config.cache, NewMockCreatRequestHandlerFactory()))
+	http.HandleFunc("/stats", requestHandler("/stats", config.cache, NewStatsRequestHandlerFactory()))
+	http.HandleFunc("/admin/reencrypt", methodHandler(map[string]func(w http.ResponseWriter, req *http.Request){
+		http.MethodPost: requestHandler("/admin/reencrypt", config.cache, NewReencryptRequestHandlerFactory()),
+		http.MethodGet:  requestHandler("/admin/reencrypt", config.cache, NewReencryptStatusHandlerFactory()),
+	}))
+	http.HandleFunc("/admin/shred", requestHandler("/admin/shred", config.cache, NewShredRequestHandlerFactory()))
+	http.HandleFunc(jobsPattern, methodHandler(map[string]func(w http.ResponseWriter, req *http.Request){
+		http.MethodGet:    requestHandler(jobsPattern, config.cache, NewJobStatusHandlerFactory()),
+		http.MethodDelete: requestHandler(jobsPattern, config.cache, NewJobCancelHandlerFactory()),
+	}))
+	http.HandleFunc(datasetsListPattern, requestHandler(datasetsListPattern, config.cache, NewDatasetListHandlerFactory()))
+	http.HandleFunc(datasetsPattern, methodHandler(map[string]func(w http.ResponseWriter, req *http.Request){
+		http.MethodGet:    requestHandler(datasetsPattern, config.cache, NewDatasetManifestHandlerFactory()),
+		http.MethodDelete: requestHandler(datasetsPattern, config.cache, NewDatasetDeleteHandlerFactory()),
+	}))
+	http.HandleFunc("/existing", requestHandler("/existing", config.cache, NewExistingRequestHandlerFactory()))
 	http.ListenAndServe(fmt.Sprintf(":%v", config.port), nil)
 }
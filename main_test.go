@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gford1000-go/logger"
+)
+
+// TestMain discards the log, which is needed by the caches created by tests
+func TestMain(m *testing.M) {
+	logger.NewLogger(ioutil.Discard, logger.All, "DataProxy ")
+	os.Exit(m.Run())
+}
+
+// newTestCacheConfig returns a cache created with the options, by default a file
+// store in a temporary folder, which is closed when the test ends
+func newTestCacheConfig(t *testing.T, opts cacheOptions) *cacheConfig {
+	t.Helper()
+
+	if opts.storeKind == "" {
+		opts.storeKind = "file"
+	}
+	if opts.store.root == "" {
+		opts.store.root = t.TempDir()
+	}
+	if opts.evictPolicy == "" {
+		opts.evictPolicy = evictLRU
+	}
+	if opts.gcInterval == 0 {
+		opts.gcInterval = time.Hour
+	}
+
+	config, err := newCacheConfig(&opts)
+	if err != nil {
+		t.Fatalf("Error creating cache - %v", err)
+	}
+	t.Cleanup(func() { config.close() })
+	return config
+}
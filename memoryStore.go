@@ -0,0 +1,176 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+)
+
+// memoryPage is an entry in the memoryStore
+type memoryPage struct {
+	hash string
+	key  string
+	data []byte
+}
+
+// memoryStats reports the usage of a memoryStore
+type memoryStats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Pages     int    `json:"pages"`
+	Bytes     int64  `json:"bytes"`
+	Budget    int64  `json:"budget"`
+}
+
+// memoryStore is a PageStore that holds pages in process memory, evicting
+// the least recently used pages when the byte budget would be exceeded.
+// The metadata of datasets, held under reserved keys, is never evicted.
+type memoryStore struct {
+	lock   sync.Mutex
+	budget int64
+	size   int64
+	pages  map[string]map[string]*list.Element
+	lru    *list.List
+	// reserved holds the pages under reserved keys, which are not evicted
+	reserved *list.List
+	stats    memoryStats
+}
+
+// newMemoryStore returns a memoryStore that holds up to budget bytes of pages
+func newMemoryStore(budget int64) *memoryStore {
+	return &memoryStore{
+		budget:   budget,
+		pages:    map[string]map[string]*list.Element{},
+		lru:      list.New(),
+		reserved: list.New(),
+	}
+}
+
+func (m *memoryStore) Put(hash, key string, data []byte) error {
+	if int64(len(data)) > m.budget {
+		return fmt.Errorf("page of %v bytes exceeds memory budget", len(data))
+	}
+
+	// Copy, so that the caller is free to reuse data
+	page := &memoryPage{hash: hash, key: key, data: append([]byte{}, data...)}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.remove(hash, key)
+
+	for m.size+int64(len(page.data)) > m.budget {
+		e := m.lru.Back()
+		if e == nil {
+			return fmt.Errorf("page of %v bytes exceeds memory budget, once reserved pages are held", len(data))
+		}
+		oldest := e.Value.(*memoryPage)
+		m.remove(oldest.hash, oldest.key)
+		m.stats.Evictions++
+	}
+
+	keys, ok := m.pages[hash]
+	if !ok {
+		keys = map[string]*list.Element{}
+		m.pages[hash] = keys
+	}
+	keys[key] = m.list(key).PushFront(page)
+	m.size += int64(len(page.data))
+
+	return nil
+}
+
+// Get returns the page held in memory; the returned slice must not be modified
+func (m *memoryStore) Get(hash, key string) ([]byte, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if e, ok := m.pages[hash][key]; ok {
+		m.stats.Hits++
+		m.list(key).MoveToFront(e)
+		return e.Value.(*memoryPage).data, nil
+	}
+
+	m.stats.Misses++
+	return nil, errPageNotFound
+}
+
+func (m *memoryStore) Delete(hash, key string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.remove(hash, key)
+	return nil
+}
+
+func (m *memoryStore) List(hash string) ([]string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	keys := []string{}
+	for key := range m.pages[hash] {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (m *memoryStore) Datasets() ([]string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	hashes := []string{}
+	for hash := range m.pages {
+		hashes = append(hashes, hash)
+	}
+	return hashes, nil
+}
+
+func (m *memoryStore) DeleteDataset(hash string) (int64, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var freed int64
+	for key, e := range m.pages[hash] {
+		freed += int64(len(e.Value.(*memoryPage).data))
+		m.remove(hash, key)
+	}
+	return freed, nil
+}
+
+// Stats returns a snapshot of the usage of the store
+func (m *memoryStore) Stats() interface{} {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	s := m.stats
+	s.Pages = m.lru.Len() + m.reserved.Len()
+	s.Bytes = m.size
+	s.Budget = m.budget
+	return s
+}
+
+// remove discards the page if present; the caller must hold the lock
+func (m *memoryStore) remove(hash, key string) {
+	keys, ok := m.pages[hash]
+	if !ok {
+		return
+	}
+	if e, ok := keys[key]; ok {
+		m.size -= int64(len(e.Value.(*memoryPage).data))
+		m.list(key).Remove(e)
+		delete(keys, key)
+	}
+	if len(keys) == 0 {
+		delete(m.pages, hash)
+	}
+}
+
+// list returns the list that holds the page with the key; pages under the keys
+// reserved for the metadata of datasets are held apart, so that they are not evicted
+func (m *memoryStore) list(key string) *list.List {
+	if key == datasetKey || key == checkpointKey {
+		return m.reserved
+	}
+	return m.lru
+}
@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestMemoryStoreKeepsReservedKeys(t *testing.T) {
+	m := newMemoryStore(100)
+
+	if err := m.Put("d1", datasetKey, make([]byte, 10)); err != nil {
+		t.Fatalf("Put dataset - %v", err)
+	}
+	if err := m.Put("d1", checkpointKey, make([]byte, 10)); err != nil {
+		t.Fatalf("Put checkpoint - %v", err)
+	}
+
+	// Pages filling the budget evict each other, but never the metadata
+	for _, key := range []string{"p1", "p2", "p3", "p4"} {
+		if err := m.Put("d1", key, make([]byte, 40)); err != nil {
+			t.Fatalf("Put %v - %v", key, err)
+		}
+	}
+	for _, key := range []string{datasetKey, checkpointKey, "p3", "p4"} {
+		if _, err := m.Get("d1", key); err != nil {
+			t.Errorf("Get %v - %v", key, err)
+		}
+	}
+	for _, key := range []string{"p1", "p2"} {
+		if _, err := m.Get("d1", key); err != errPageNotFound {
+			t.Errorf("Get %v returned %v, expected it to be evicted", key, err)
+		}
+	}
+
+	// A page cannot displace the metadata held
+	if err := m.Put("d1", "p5", make([]byte, 90)); err == nil {
+		t.Error("Put of page larger than the budget left by the metadata succeeded")
+	}
+	if _, err := m.Get("d1", datasetKey); err != nil {
+		t.Errorf("Get %v after oversized Put - %v", datasetKey, err)
+	}
+
+	if freed, _ := m.DeleteDataset("d1"); freed != 20 {
+		t.Errorf("DeleteDataset freed %v bytes, expected 20", freed)
+	}
+	if s := m.Stats().(memoryStats); s.Pages != 0 || s.Bytes != 0 {
+		t.Errorf("Stats after DeleteDataset reported %v pages of %v bytes", s.Pages, s.Bytes)
+	}
+}
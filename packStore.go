@@ -0,0 +1,470 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// packFileName is the name of the segment file within each dataset folder
+const packFileName = "pages.pack"
+
+// packHeaderSize is the size of the header preceding each record in a segment:
+// flags (1 byte), key length (2 bytes), data length (4 bytes)
+const packHeaderSize = 7
+
+const (
+	// packDeleted marks a record as a tombstone for its key
+	packDeleted byte = 1 << iota
+)
+
+// packEntry locates the data of a page within a segment file
+type packEntry struct {
+	offset int64
+	length int64
+	flags  byte
+}
+
+// packSegment is the append-only segment file of a single dataset, together
+// with the index of the latest record for each key
+type packSegment struct {
+	lock     sync.RWMutex
+	fileName string
+	index    map[string]packEntry
+	size     int64
+	// deleted is set once the dataset is deleted, after which the segment is not written
+	deleted bool
+}
+
+// packStore is a PageStore that appends all the pages of a dataset to a single
+// segment file, so that each dataset consumes a single file however many pages
+// it has.  Records are synced as they are appended, so pages are durable once put.
+// Replaced and deleted pages remain in the segment until it is compacted.
+type packStore struct {
+	root     string
+	lock     sync.Mutex
+	segments map[string]*packSegment
+}
+
+// newPackStore returns a packStore that uses the specified root folder
+func newPackStore(root string) *packStore {
+	return &packStore{
+		root:     root,
+		segments: map[string]*packSegment{},
+	}
+}
+
+// segment returns the segment for the dataset, loading its index if required
+func (p *packStore) segment(hash string) (*packSegment, error) {
+	if err := validateHash(hash); err != nil {
+		return nil, err
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if s, ok := p.segments[hash]; ok {
+		return s, nil
+	}
+
+	s := &packSegment{
+		fileName: fmt.Sprintf("%v/%v/%v", p.root, hash, packFileName),
+		index:    map[string]packEntry{},
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	p.segments[hash] = s
+	return s, nil
+}
+
+// lockSegment returns the segment for the dataset, locked exclusively.  A segment
+// deleted whilst waiting for the lock is loaded again, so that records are never
+// appended using the size of a segment file that no longer exists.
+func (p *packStore) lockSegment(hash string) (*packSegment, error) {
+	for {
+		s, err := p.segment(hash)
+		if err != nil {
+			return nil, err
+		}
+		s.lock.Lock()
+		if !s.deleted {
+			return s, nil
+		}
+		s.lock.Unlock()
+	}
+}
+
+// load builds the index by scanning the record headers of the segment file.
+// A partially written record at the end of the file is truncated, so that
+// subsequent appends remain aligned.
+func (s *packSegment) load() error {
+	f, err := os.Open(s.fileName)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	var offset int64
+	header := make([]byte, packHeaderSize)
+	for offset+packHeaderSize <= info.Size() {
+		if _, err := f.ReadAt(header, offset); err != nil {
+			return err
+		}
+		flags := header[0]
+		keyLen := int64(binary.BigEndian.Uint16(header[1:3]))
+		dataLen := int64(binary.BigEndian.Uint32(header[3:7]))
+
+		end := offset + packHeaderSize + keyLen + dataLen
+		if end > info.Size() {
+			break
+		}
+
+		key := make([]byte, keyLen)
+		if _, err := f.ReadAt(key, offset+packHeaderSize); err != nil {
+			return err
+		}
+
+		if flags&packDeleted != 0 {
+			delete(s.index, string(key))
+		} else {
+			s.index[string(key)] = packEntry{
+				offset: offset + packHeaderSize + keyLen,
+				length: dataLen,
+				flags:  flags,
+			}
+		}
+		offset = end
+	}
+
+	s.size = offset
+	if offset < info.Size() {
+		return os.Truncate(s.fileName, offset)
+	}
+	return nil
+}
+
+// append writes a single record to the end of the segment, syncing it if requested so
+// that the record is durable once appended; the caller must hold the lock
+func (s *packSegment) append(key string, data []byte, flags byte, sync bool) (packEntry, error) {
+	if len(key) > 0xFFFF || int64(len(data)) > 0xFFFFFFFF {
+		return packEntry{}, fmt.Errorf("page too large for segment")
+	}
+
+	record := make([]byte, packHeaderSize, packHeaderSize+len(key)+len(data))
+	record[0] = flags
+	binary.BigEndian.PutUint16(record[1:3], uint16(len(key)))
+	binary.BigEndian.PutUint32(record[3:7], uint32(len(data)))
+	record = append(record, key...)
+	record = append(record, data...)
+
+	f, err := os.OpenFile(s.fileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return packEntry{}, err
+	}
+	defer f.Close()
+
+	_, err = f.Write(record)
+	if err == nil && sync {
+		err = f.Sync()
+	}
+	if err != nil {
+		// Discard any partial record, so that the segment remains readable
+		os.Truncate(s.fileName, s.size)
+		return packEntry{}, err
+	}
+
+	e := packEntry{
+		offset: s.size + packHeaderSize + int64(len(key)),
+		length: int64(len(data)),
+		flags:  flags,
+	}
+	s.size += int64(len(record))
+	return e, nil
+}
+
+func (p *packStore) Put(hash, key string, data []byte) error {
+	s, err := p.lockSegment(hash)
+	if err != nil {
+		return err
+	}
+	defer s.lock.Unlock()
+
+	if err := os.MkdirAll(fmt.Sprintf("%v/%v", p.root, hash), 0744); err != nil {
+		return err
+	}
+
+	e, err := s.append(key, data, 0, true)
+	if err != nil {
+		return err
+	}
+	s.index[key] = e
+	return nil
+}
+
+func (p *packStore) Get(hash, key string) ([]byte, error) {
+	s, err := p.segment(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	e, ok := s.index[key]
+	if !ok {
+		return nil, errPageNotFound
+	}
+
+	f, err := os.Open(s.fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data := make([]byte, e.length)
+	if _, err := f.ReadAt(data, e.offset); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return data, nil
+}
+
+// OpenPage returns the segment file of the dataset.  The file remains readable
+// should the segment subsequently be compacted or deleted.
+func (p *packStore) OpenPage(hash, key string) (*os.File, int64, int64, error) {
+	s, err := p.segment(hash)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	e, ok := s.index[key]
+	if !ok {
+		return nil, 0, 0, errPageNotFound
+	}
+
+	f, err := os.Open(s.fileName)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return f, e.offset, e.length, nil
+}
+
+func (p *packStore) Delete(hash, key string) error {
+	s, err := p.lockSegment(hash)
+	if err != nil {
+		return err
+	}
+	defer s.lock.Unlock()
+
+	if _, ok := s.index[key]; !ok {
+		return nil
+	}
+	if _, err := s.append(key, nil, packDeleted, true); err != nil {
+		return err
+	}
+	delete(s.index, key)
+	return nil
+}
+
+func (p *packStore) List(hash string) ([]string, error) {
+	s, err := p.segment(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	keys := []string{}
+	for key := range s.index {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (p *packStore) Datasets() ([]string, error) {
+	return newFileStore(p.root).Datasets()
+}
+
+func (p *packStore) DeleteDataset(hash string) (int64, error) {
+	s, err := p.lockSegment(hash)
+	if err != nil {
+		return 0, err
+	}
+	defer s.lock.Unlock()
+
+	freed := s.size
+	err = os.RemoveAll(fmt.Sprintf("%v/%v", p.root, hash))
+
+	// Only once the folder is removed is the segment removed from the store, whilst
+	// still locked, so that no new segment is written until the removal is complete.
+	// Subsequent requests, and those waiting to write, load the segment again.
+	p.lock.Lock()
+	delete(p.segments, hash)
+	p.lock.Unlock()
+	s.deleted = true
+	s.index = map[string]packEntry{}
+	s.size = 0
+	return freed, err
+}
+
+// Compact rewrites the segment of the dataset so that it only contains the
+// current version of each page, returning the number of bytes reclaimed
+func (p *packStore) Compact(hash string) (int64, error) {
+	s, err := p.lockSegment(hash)
+	if err != nil {
+		return 0, err
+	}
+	defer s.lock.Unlock()
+
+	src, err := os.Open(s.fileName)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	compacted := &packSegment{
+		fileName: s.fileName + tempSuffix,
+		index:    map[string]packEntry{},
+	}
+	os.Remove(compacted.fileName)
+
+	for key, e := range s.index {
+		data := make([]byte, e.length)
+		if _, err := src.ReadAt(data, e.offset); err != nil && err != io.EOF {
+			os.Remove(compacted.fileName)
+			return 0, err
+		}
+		// The compacted segment is synced once complete, rather than by record
+		ce, err := compacted.append(key, data, e.flags, false)
+		if err != nil {
+			os.Remove(compacted.fileName)
+			return 0, err
+		}
+		compacted.index[key] = ce
+	}
+
+	if err := syncFile(compacted.fileName); err != nil {
+		os.Remove(compacted.fileName)
+		return 0, err
+	}
+
+	if err := os.Rename(compacted.fileName, s.fileName); err != nil {
+		os.Remove(compacted.fileName)
+		return 0, err
+	}
+
+	reclaimed := s.size - compacted.size
+	s.index = compacted.index
+	s.size = compacted.size
+	return reclaimed, nil
+}
+
+// CompactAll compacts the segments of every dataset held under root, returning
+// the total number of bytes reclaimed
+func (p *packStore) CompactAll() (int64, error) {
+	entries, err := ioutil.ReadDir(p.root)
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(fmt.Sprintf("%v/%v/%v", p.root, e.Name(), packFileName)); err != nil {
+			continue
+		}
+		reclaimed, err := p.Compact(e.Name())
+		if err != nil {
+			return total, err
+		}
+		total += reclaimed
+	}
+	return total, nil
+}
+
+// RemoveTempFiles deletes segments left behind by compactions that did not complete,
+// together with the temporary files of any datasets yet to be converted
+func (p *packStore) RemoveTempFiles() (int, error) {
+	count, err := newFileStore(p.root).RemoveTempFiles()
+	if err != nil {
+		return count, err
+	}
+	n, err := removeDatasetTempFiles(p.root, packFileName, func(name string) bool {
+		return name == packFileName+tempSuffix
+	})
+	return count + n, err
+}
+
+// syncFile flushes the contents of the file to storage
+func syncFile(fileName string) error {
+	f, err := os.OpenFile(fileName, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// ConvertFileDatasets moves the pages of datasets held by a fileStore with the
+// same root into segments, returning the number of pages converted.  Each page
+// file is only removed once it has been appended to the segment.
+func (p *packStore) ConvertFileDatasets() (int, error) {
+	entries, err := ioutil.ReadDir(p.root)
+	if err != nil {
+		return 0, err
+	}
+
+	files := newFileStore(p.root)
+
+	count := 0
+	for _, e := range entries {
+		if !e.IsDir() || validateHash(e.Name()) != nil {
+			continue
+		}
+		hash := e.Name()
+
+		keys, err := files.List(hash)
+		if err != nil {
+			return count, err
+		}
+
+		for _, key := range keys {
+			if key == packFileName {
+				continue
+			}
+			data, err := files.Get(hash, key)
+			if err != nil {
+				return count, err
+			}
+			if err := p.Put(hash, key, data); err != nil {
+				return count, err
+			}
+			if err := files.Delete(hash, key); err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+	return count, nil
+}
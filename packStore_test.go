@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestPackStorePutDuringDeleteDataset(t *testing.T) {
+	root := t.TempDir()
+	p := newPackStore(root)
+
+	var wg sync.WaitGroup
+	for w := 0; w < 16; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				key := fmt.Sprintf("w%v-%v", w, i)
+				if err := p.Put("h1", key, []byte("data of "+key)); err != nil {
+					t.Errorf("Put - %v", err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			if _, err := p.DeleteDataset("h1"); err != nil {
+				t.Errorf("DeleteDataset - %v", err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+
+	// Every page that survived is intact, both as indexed by the store and when
+	// the segment is loaded afresh
+	for _, s := range []*packStore{p, newPackStore(root)} {
+		keys, err := s.List("h1")
+		if err != nil {
+			t.Fatalf("List - %v", err)
+		}
+		for _, key := range keys {
+			data, err := s.Get("h1", key)
+			if err != nil {
+				t.Fatalf("Get - %v", err)
+			}
+			if string(data) != "data of "+key {
+				t.Fatalf("page %v is corrupt: %q", key, data)
+			}
+		}
+	}
+}
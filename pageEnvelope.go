@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+)
+
+// envelopeMagic identifies a stored page that begins with a pageEnvelope header
+var envelopeMagic = []byte("DPXP")
+
+// envelopeVersion is the format version of pages written by this server.
+// Version 2 authenticates the identity of the page when it is encrypted (see pageAAD),
+// and version 3 also its content type.
+const envelopeVersion byte = 3
+
+// aadEnvelopeVersion is the first version whose encrypted pages use pageAAD
+const aadEnvelopeVersion byte = 2
+
+// contentTypeAADVersion is the first version whose additional data includes the content type
+const contentTypeAADVersion byte = 3
+
+// pageContentType is the content type of the pages created by this server
+const pageContentType = "application/json"
+
+const (
+	codecNone byte = iota
+	codecLZ4
+	codecZstd
+	codecSnappy
+	codecGzip
+)
+
+const (
+	encryptionNone byte = iota
+	// encryptionAESGCM pages are sealed by the keyring key identified in the envelope
+	encryptionAESGCM
+	// encryptionDataKey pages are sealed by the data key of their dataset
+	encryptionDataKey
+)
+
+// errNoEnvelope is returned when a stored page does not have an envelope header,
+// and so was written by an earlier version of the server
+var errNoEnvelope = errors.New("page has no envelope")
+
+// errEnvelopeCorrupt is returned when an envelope header cannot be read,
+// or the page does not match its checksum
+var errEnvelopeCorrupt = errors.New("page envelope is corrupt")
+
+// pageEnvelope describes how a stored page has been encoded, so that each page
+// can be decoded regardless of the current configuration of the server.
+//
+// The header is: magic (4 bytes), version, codec, encryption (1 byte each),
+// key ID and content type (each a 1 byte length followed by the string), and
+// the CRC32 checksum of the payload (4 bytes).
+type pageEnvelope struct {
+	version     byte
+	codec       byte
+	encryption  byte
+	keyID       string
+	contentType string
+}
+
+// encode returns the payload preceded by the envelope header
+func (e *pageEnvelope) encode(payload []byte) []byte {
+	keyID := truncate(e.keyID, 255)
+	contentType := truncate(e.contentType, 255)
+
+	header := make([]byte, 0, e.headerSize()+len(payload))
+	header = append(header, envelopeMagic...)
+	header = append(header, e.version, e.codec, e.encryption)
+	header = append(header, byte(len(keyID)))
+	header = append(header, keyID...)
+	header = append(header, byte(len(contentType)))
+	header = append(header, contentType...)
+	header = binary.BigEndian.AppendUint32(header, crc32.ChecksumIEEE(payload))
+
+	return append(header, payload...)
+}
+
+// headerSize returns the number of bytes in the encoded header
+func (e *pageEnvelope) headerSize() int {
+	return len(envelopeMagic) + 3 + 1 + len(truncate(e.keyID, 255)) + 1 + len(truncate(e.contentType, 255)) + 4
+}
+
+// maxHeaderSize is the largest number of bytes an encoded header can occupy
+const maxHeaderSize = 4 + 3 + 1 + 255 + 1 + 255 + 4
+
+// decodeEnvelope returns the envelope and payload of a stored page.
+// errNoEnvelope is returned if the page does not begin with an envelope.
+func decodeEnvelope(raw []byte) (*pageEnvelope, []byte, error) {
+	e, checksum, n, err := decodeHeader(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	payload := raw[n:]
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return nil, nil, errEnvelopeCorrupt
+	}
+
+	return e, payload, nil
+}
+
+// decodeHeader returns the envelope, payload checksum and header size of a stored page,
+// given at least its header.  errNoEnvelope is returned if the page does not begin with
+// an envelope.
+func decodeHeader(raw []byte) (*pageEnvelope, uint32, int, error) {
+	if len(raw) < len(envelopeMagic) || string(raw[:len(envelopeMagic)]) != string(envelopeMagic) {
+		return nil, 0, 0, errNoEnvelope
+	}
+
+	p := raw[len(envelopeMagic):]
+	readString := func() (string, bool) {
+		if len(p) < 1 || len(p) < 1+int(p[0]) {
+			return "", false
+		}
+		s := string(p[1 : 1+int(p[0])])
+		p = p[1+int(p[0]):]
+		return s, true
+	}
+
+	if len(p) < 3 {
+		return nil, 0, 0, errEnvelopeCorrupt
+	}
+	e := &pageEnvelope{version: p[0], codec: p[1], encryption: p[2]}
+	p = p[3:]
+
+	if e.version < 1 || e.version > envelopeVersion {
+		return nil, 0, 0, errEnvelopeCorrupt
+	}
+
+	var ok bool
+	if e.keyID, ok = readString(); !ok {
+		return nil, 0, 0, errEnvelopeCorrupt
+	}
+	if e.contentType, ok = readString(); !ok {
+		return nil, 0, 0, errEnvelopeCorrupt
+	}
+
+	if len(p) < 4 {
+		return nil, 0, 0, errEnvelopeCorrupt
+	}
+	return e, binary.BigEndian.Uint32(p[:4]), len(raw) - len(p) + 4, nil
+}
+
+// pageAAD returns the additional authenticated data for an encrypted page, which
+// binds the page to its dataset and page key (itself derived from the page token),
+// and to the envelope describing it, so that a page copied to another dataset or
+// location, or whose envelope is altered, fails to decrypt.  Pages written before
+// aadEnvelopeVersion have no additional data, and those written before
+// contentTypeAADVersion do not bind their content type.
+func pageAAD(env *pageEnvelope, hash, key string) []byte {
+	if env.version < aadEnvelopeVersion {
+		return nil
+	}
+
+	aad := make([]byte, 0, len(envelopeMagic)+5+len(env.keyID)+len(env.contentType)+len(hash)+len(key)+2)
+	aad = append(aad, envelopeMagic...)
+	aad = append(aad, env.version, env.codec, env.encryption, byte(len(env.keyID)))
+	aad = append(aad, env.keyID...)
+	if env.version >= contentTypeAADVersion {
+		contentType := truncate(env.contentType, 255)
+		aad = append(aad, byte(len(contentType)))
+		aad = append(aad, contentType...)
+	}
+	aad = append(aad, 0)
+	aad = append(aad, hash...)
+	aad = append(aad, 0)
+	aad = append(aad, key...)
+	return aad
+}
+
+// truncate limits s to at most n bytes
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"crypto/aes"
+	"testing"
+)
+
+func TestPageAADBindsEnvelope(t *testing.T) {
+	block, err := aes.NewCipher([]byte("0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, version := range []byte{aadEnvelopeVersion, envelopeVersion} {
+		env := &pageEnvelope{
+			version:     version,
+			encryption:  encryptionAESGCM,
+			keyID:       "k1",
+			contentType: pageContentType,
+		}
+		sealed, err := seal(block, []byte("page"), pageAAD(env, "h1", "key"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decoded, payload, err := decodeEnvelope(env.encode(sealed))
+		if err != nil {
+			t.Fatalf("decodeEnvelope - %v", err)
+		}
+		if _, err := unseal(block, payload, pageAAD(decoded, "h1", "key")); err != nil {
+			t.Fatalf("version %v: unseal - %v", version, err)
+		}
+
+		// Pages are bound to their location
+		if _, err := unseal(block, payload, pageAAD(decoded, "h2", "key")); err == nil {
+			t.Fatalf("version %v: page moved to another dataset was unsealed", version)
+		}
+
+		// The content type is bound from contentTypeAADVersion
+		altered := *decoded
+		altered.contentType = "text/csv"
+		_, err = unseal(block, payload, pageAAD(&altered, "h1", "key"))
+		if bound := version >= contentTypeAADVersion; bound != (err != nil) {
+			t.Fatalf("version %v: altered content type rejected %v, expected %v", version, err != nil, bound)
+		}
+	}
+}
@@ -3,8 +3,11 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // PageRequest is the expected request body to identify a
@@ -12,18 +15,36 @@ import (
 type PageRequest struct {
 	RequestHash string `json:"hash"`
 	PageToken   string `json:"token"`
+	// MaxWaitMillis is how long to wait for a page that is yet to be written by
+	// an ingest in progress; if zero, or the page is still not written, then
+	// 202 Accepted is returned so that the request can be retried
+	MaxWaitMillis int `json:"max_wait_ms"`
 }
 
+// PendingPageResponse is returned with 202 Accepted for a page that is yet to be
+// written by an ingest in progress
+type PendingPageResponse struct {
+	RequestHash string `json:"hash"`
+	PageToken   string `json:"token"`
+	State       string `json:"state"`
+}
+
+// maxPageWait limits how long a request waits for a page to be written
+const maxPageWait = 30 * time.Second
+
+// pendingRetryAfter is the number of seconds after which a pending page should be requested again
+const pendingRetryAfter = 1
+
 func NewPageRequestHandlerFactory(maxHandlers int) HandlerFactory {
 	factory := &pageRequestHandlerFactory{
-		get: make(chan chan *pageRequestHandler, maxHandlers),
-		put: make(chan *pageRequestHandler, maxHandlers),
+		get: make(chan chan *pageBuffer, maxHandlers),
+		put: make(chan *pageBuffer, maxHandlers),
 	}
 
 	go func() {
 
 		for i := 0; i < cap(factory.put); i++ {
-			factory.put <- &pageRequestHandler{c: factory.put}
+			factory.put <- &pageBuffer{}
 		}
 
 		for {
@@ -37,19 +58,25 @@ func NewPageRequestHandlerFactory(maxHandlers int) HandlerFactory {
 	return factory
 }
 
+// pageBuffer holds the data of pages being retrieved, and is reused by successive
+// requests.  The fixed number of buffers bounds the pages retrieved at once.
+type pageBuffer struct {
+	data []byte
+}
+
 type pageRequestHandlerFactory struct {
-	get chan chan *pageRequestHandler
-	put chan *pageRequestHandler
+	get chan chan *pageBuffer
+	put chan *pageBuffer
 }
 
-func (f *pageRequestHandlerFactory) getHandler() *pageRequestHandler {
-	c := make(chan *pageRequestHandler)
+func (f *pageRequestHandlerFactory) getBuffer() *pageBuffer {
+	c := make(chan *pageBuffer)
 	f.get <- c
 	return <-c
 }
 
 func (f *pageRequestHandlerFactory) New(pattern string, config *cacheConfig, requestID string) Handler {
-	h := f.getHandler()
+	h := &pageRequestHandler{factory: f}
 	h.method = http.MethodPost
 	h.config = config
 	h.handler = h.handlePageRetrieval
@@ -61,16 +88,21 @@ func (f *pageRequestHandlerFactory) New(pattern string, config *cacheConfig, req
 
 type pageRequestHandler struct {
 	baseHandler
-	c chan *pageRequestHandler
+	factory *pageRequestHandlerFactory
+}
+
+// acquire takes a buffer from the factory, which is returned once the request is processed
+func (p *pageRequestHandler) acquire() {
+	buf := p.factory.getBuffer()
+	p.data = buf.data
+	p.release = func() {
+		buf.data = p.data
+		p.factory.put <- buf
+	}
 }
 
 // handlePageRetrieval is invoked after the initial authorization and validation checks are completed
 func (p *pageRequestHandler) handlePageRetrieval(w http.ResponseWriter, req *http.Request) {
-	// Ensure p is returned to the factory after use
-	defer func() {
-		p.c <- p
-	}()
-
 	// Validate the content type requested
 	reqSupportableTypes, allSupportedTypes := getRequestSupportedTypes(req)
 	if len(reqSupportableTypes) == 0 {
@@ -86,21 +118,118 @@ func (p *pageRequestHandler) handlePageRetrieval(w http.ResponseWriter, req *htt
 		return
 	}
 
-	// Retrieve page from cache
+	// Pages yet to be written by an ingest in progress are awaited, as requested
+	if !p.awaitPage(req, &pg) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Retry-After", strconv.Itoa(pendingRetryAfter))
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(&PendingPageResponse{
+			RequestHash: pg.RequestHash,
+			PageToken:   pg.PageToken,
+			State:       "pending",
+		})
+		return
+	}
+
+	// Pages are retrieved using a pooled buffer, which is only taken once any wait is over
+	p.acquire()
+
+	// Retrieve page from cache, compressed if the client accepts a codec
+	encodings, refused := getRequestEncodings(req)
 	info := &pageInfo{
 		hash:           pg.RequestHash,
 		token:          pg.PageToken,
 		types:          reqSupportableTypes,
-		useCompression: false,
+		useCompression: len(encodings) > 0,
+		encodings:      encodings,
+		refused:        refused,
+	}
+	// Stream pages held in files, where the page is returned as stored
+	var body *pageBody
+	if opener, ok := p.config.store.(pageFileOpener); ok && p.config.streamPages && info.types[0] == pageContentType {
+		body, err = p.streamPage(opener, info)
+	} else {
+		var b []byte
+		if b, err = p.getPage(info); err == nil {
+			body = newPageBody(b, info.encoding)
+		}
+	}
+	if err == errDatasetExpired {
+		returnError(w, err.Error(), http.StatusGone)
+		return
 	}
-	b, err := p.getPage(info)
 	if err != nil {
 		returnError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	defer body.Close()
+
+	// Pages streamed as they are written may fail part way, when decompressed or
+	// verified, so the first block is read before the status is sent, so that
+	// failures of small pages, and most others, are still reported
+	first := make([]byte, streamFirstBlock)
+	n, err := io.ReadFull(body.Reader, first)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		p.Error("Page %v: Error reading page - %v", info.token, err)
+		returnError(w, "internal failure handling page (4)", http.StatusInternalServerError)
+		return
+	}
+	first = first[:n]
 
 	// Return page
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Vary", "Accept-Encoding")
+	if body.encoding != "" {
+		w.Header().Set("Content-Encoding", body.encoding)
+	}
+	if body.length >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(body.length, 10))
+	}
 	w.WriteHeader(http.StatusOK)
-	w.Write(b)
+
+	// A failure once the status is sent aborts the response, so that the client does
+	// not take a truncated or corrupt page to be complete.
+	_, err = w.Write(first)
+	if err == nil {
+		_, err = io.Copy(w, body.Reader)
+	}
+	if err != nil {
+		p.Error("Page %v: Error writing response - %v", info.token, err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// awaitPage returns false if the page is yet to be written by an ingest in progress,
+// having waited for up to the time requested.  Otherwise the page is either written,
+// or will never be written, and so true is returned.
+func (p *pageRequestHandler) awaitPage(req *http.Request, pg *PageRequest) bool {
+	job := p.config.jobs.get(pg.RequestHash)
+	if job == nil {
+		return true
+	}
+	ready := job.pendingPage(pg.PageToken)
+	if ready == nil {
+		return true
+	}
+
+	wait := time.Duration(pg.MaxWaitMillis) * time.Millisecond
+	if wait > maxPageWait {
+		wait = maxPageWait
+	}
+	if wait <= 0 {
+		return false
+	}
+
+	p.Debug("Page %v: Waiting up to %v for page to be written", pg.PageToken, wait)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-ready:
+		return true
+	case <-timer.C:
+		return false
+	case <-req.Context().Done():
+		return false
+	}
 }
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// errPageNotFound is returned by a PageStore when the requested page does not exist
+var errPageNotFound = errors.New("page not found")
+
+// PageStore describes the persistence of pages, once they have been compressed and
+// encrypted.  Pages are grouped by the request hash of their dataset, and identified
+// within the dataset by a key derived from the page token (see getPageKey)
+type PageStore interface {
+	// Put saves the page, replacing any existing page with the same key
+	Put(hash, key string, data []byte) error
+	// Get returns the page, or errPageNotFound if it does not exist
+	Get(hash, key string) ([]byte, error)
+	// Delete removes the page; deleting a page that does not exist is not an error
+	Delete(hash, key string) error
+	// List returns the keys of all pages held for the dataset
+	List(hash string) ([]string, error)
+	// Datasets returns the hashes of all datasets held
+	Datasets() ([]string, error)
+	// DeleteDataset removes all pages of the dataset, returning the bytes freed
+	DeleteDataset(hash string) (int64, error)
+}
+
+// batchPageStore is implemented by PageStores that can save several pages
+// of a dataset atomically
+type batchPageStore interface {
+	PutPages(hash string, pages map[string][]byte) error
+}
+
+// putPages saves the pages to the store, atomically if the store supports it
+func putPages(store PageStore, hash string, pages map[string][]byte) error {
+	if b, ok := store.(batchPageStore); ok {
+		return b.PutPages(hash, pages)
+	}
+	for key, data := range pages {
+		if err := store.Put(hash, key, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tempFileRemover is implemented by PageStores that write via temporary files,
+// which may be left behind if the process stops during a write
+type tempFileRemover interface {
+	RemoveTempFiles() (int, error)
+}
+
+// datasetCompactor is implemented by PageStores that retain replaced pages until
+// the dataset is compacted
+type datasetCompactor interface {
+	Compact(hash string) (int64, error)
+}
+
+// pageFileOpener is implemented by PageStores that hold each page within a local
+// file, so that pages can be served from the file rather than read into memory
+type pageFileOpener interface {
+	// OpenPage returns the file holding the page, and the offset and length of the
+	// page within it, or errPageNotFound if it does not exist.  The caller closes the file.
+	OpenPage(hash, key string) (f *os.File, offset, length int64, err error)
+}
+
+// storeOptions specifies how PageStores should be created
+type storeOptions struct {
+	root         string
+	memoryBudget int64
+	tierPolicy   string
+	promoteAfter int
+	s3           s3Config
+}
+
+// newPageStore creates the PageStore of the specified kind.  PageStores that
+// need to release resources on shutdown also implement io.Closer
+func newPageStore(kind string, opts *storeOptions) (PageStore, error) {
+	switch strings.ToLower(kind) {
+	case "file":
+		return newFileStore(opts.root), nil
+	case "pack":
+		return newPackStore(opts.root), nil
+	case "bolt":
+		return newBoltStore(opts.root)
+	case "s3":
+		return newS3Store(opts.s3)
+	case "memory":
+		return newMemoryStore(opts.memoryBudget), nil
+	case "tiered":
+		return newTieredStore(newMemoryStore(opts.memoryBudget), newFileStore(opts.root), opts.tierPolicy, opts.promoteAfter)
+	default:
+		return nil, fmt.Errorf("unsupported page store: %v", kind)
+	}
+}
+
+// validateHash ensures a hash can be safely used as part of a storage location
+func validateHash(hash string) error {
+	if len(hash) == 0 || strings.ContainsAny(hash, `/\`) || strings.Contains(hash, "..") {
+		return fmt.Errorf("invalid request hash")
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// streamFirstBlock is the bytes of a streamed page that are read before the response
+// status is sent, so that failures reading the page can still be reported
+const streamFirstBlock = 32 << 10
+
+// pageBody is a page ready to be written to a response.  Pages are streamed from
+// their source where possible, rather than held in memory.
+type pageBody struct {
+	io.Reader
+	// length is the number of bytes in the body, or -1 if not known in advance
+	length int64
+	// encoding is the content-coding of the body, if any
+	encoding string
+	closers  []io.Closer
+}
+
+// newPageBody returns a body for a page that has been read into memory
+func newPageBody(page []byte, encoding string) *pageBody {
+	return &pageBody{
+		Reader:   bytes.NewReader(page),
+		length:   int64(len(page)),
+		encoding: encoding,
+	}
+}
+
+// Close releases the resources used to stream the page
+func (p *pageBody) Close() error {
+	var err error
+	for i := len(p.closers) - 1; i >= 0; i-- {
+		if e := p.closers[i].Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// streamPage returns the page as a body streamed from the file that holds it.
+//
+// Unencrypted pages are read from the file as they are written, decompressed and
+// transcoded if required, with their checksum verified as they are read, so that
+// a corrupt page fails the body once read.  Encrypted pages are instead read fully
+// into memory, as they must be authenticated before any of the page is released,
+// but are still decompressed as they are written.
+func (b *baseHandler) streamPage(opener pageFileOpener, info *pageInfo) (*pageBody, error) {
+	b.Info("Page %v: Streaming", info.token)
+	defer b.Info("Page %v: Completed streaming", info.token)
+
+	// The dataset cannot be removed whilst the page is opened, but once open the
+	// file remains readable if the dataset is then removed
+	unlock := b.config.datasets.readLock(info.hash)
+	if err := b.checkPage(info); err != nil {
+		unlock()
+		return nil, err
+	}
+
+	key := b.getPageKey(info)
+	f, offset, length, err := opener.OpenPage(info.hash, key)
+	unlock()
+	if err != nil {
+		b.Error("Page %v: Error opening from store - %v", info.token, err)
+		return nil, fmt.Errorf("invalid request or page token")
+	}
+
+	body, err := b.streamFile(f, offset, length, info, key)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return body, nil
+}
+
+// streamFile returns the body of the page held at the offset within the file
+func (b *baseHandler) streamFile(f *os.File, offset, length int64, info *pageInfo, key string) (*pageBody, error) {
+	header := make([]byte, maxHeaderSize)
+	if length < int64(len(header)) {
+		header = header[:length]
+	}
+	if _, err := f.ReadAt(header, offset); err != nil && err != io.EOF {
+		b.Error("Page %v: Error reading envelope - %v", info.token, err)
+		return nil, fmt.Errorf("internal failure handling page (5)")
+	}
+
+	env, checksum, n, err := decodeHeader(header)
+	verify := err == nil
+	switch err {
+	case nil:
+		offset += int64(n)
+		length -= int64(n)
+	case errNoEnvelope:
+		env = b.config.legacyEnvelope()
+	default:
+		b.Error("Page %v: Error reading envelope - %v", info.token, err)
+		return nil, fmt.Errorf("internal failure handling page (5)")
+	}
+
+	body := &pageBody{length: length, closers: []io.Closer{f}}
+
+	if env.encryption == encryptionNone {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			b.Error("Page %v: Error reading from store - %v", info.token, err)
+			return nil, fmt.Errorf("internal failure handling page (5)")
+		}
+		body.Reader = io.LimitReader(f, length)
+		if verify {
+			body.Reader = &checksumReader{r: body.Reader, crc: crc32.NewIEEE(), remaining: length, expected: checksum}
+		}
+	} else {
+		page := make([]byte, length)
+		if _, err := f.ReadAt(page, offset); err != nil && err != io.EOF {
+			b.Error("Page %v: Error reading from store - %v", info.token, err)
+			return nil, fmt.Errorf("internal failure handling page (5)")
+		}
+		if verify && crc32.ChecksumIEEE(page) != checksum {
+			b.Error("Page %v: Error reading envelope - %v", info.token, errEnvelopeCorrupt)
+			return nil, fmt.Errorf("internal failure handling page (5)")
+		}
+		page, err = b.decryptPage(env, page, info, key)
+		if err != nil {
+			return nil, err
+		}
+		body.Reader = bytes.NewReader(page)
+		body.length = int64(len(page))
+	}
+
+	var stored *codec
+	if env.codec != codecNone {
+		var ok bool
+		if stored, ok = codecs[env.codec]; !ok {
+			b.Error("Page %v: Unsupported codec %v", info.token, env.codec)
+			return nil, fmt.Errorf("internal failure handling page (4)")
+		}
+	}
+
+	// Return the stored bytes as-is if the client accepts their codec
+	if info.useCompression && stored != nil && info.accepts(stored) {
+		b.Debug("Page %v: Returning %v encoded", info.token, stored.encoding)
+		body.encoding = stored.encoding
+		return body, nil
+	}
+
+	// uncompress, as the client does not accept the stored codec
+	if stored != nil {
+		zr, err := stored.newReader(body.Reader)
+		if err != nil {
+			b.Error("Page %v: %v reader error - %v", info.token, stored.name, err)
+			return nil, fmt.Errorf("internal failure handling page (4)")
+		}
+		body.Reader = zr
+		body.length = -1
+		body.closers = append(body.closers, zr)
+	}
+
+	// Transcode to a codec the client accepts, if configured to do so
+	if info.useCompression && b.config.transcode {
+		if c := info.acceptedCodec(); c != nil {
+			b.Debug("Page %v: Transcoding to %v", info.token, c.encoding)
+			pr := b.compressStream(body.Reader, c, info.token)
+			body.Reader = pr
+			body.length = -1
+			body.encoding = c.encoding
+			body.closers = append(body.closers, pr)
+		}
+	}
+
+	return body, nil
+}
+
+// checksumReader verifies the CRC32 checksum of a page as it is read, failing with
+// errEnvelopeCorrupt once all of the page has been read if it does not match, or
+// if the page ends early
+type checksumReader struct {
+	r         io.Reader
+	crc       hash.Hash32
+	remaining int64
+	expected  uint32
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.crc.Write(p[:n])
+	c.remaining -= int64(n)
+	if c.remaining <= 0 && c.crc.Sum32() != c.expected {
+		return n, errEnvelopeCorrupt
+	}
+	if err == io.EOF && c.remaining > 0 {
+		return n, errEnvelopeCorrupt
+	}
+	return n, err
+}
+
+// compressReader is a reader of a page being compressed as it is read
+type compressReader struct {
+	*io.PipeReader
+	done chan struct{}
+}
+
+// Close stops the compression, waiting for it to finish with the source of the page
+func (c *compressReader) Close() error {
+	err := c.PipeReader.Close()
+	<-c.done
+	return err
+}
+
+// compressStream returns a reader of r compressed with the codec
+func (b *baseHandler) compressStream(r io.Reader, c *codec, token string) *compressReader {
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		zw, err := c.newWriter(pw, b.config.compressionLevel)
+		if err == nil {
+			_, err = io.Copy(zw, r)
+			if e := zw.Close(); err == nil {
+				err = e
+			}
+		}
+		if err != nil && err != io.ErrClosedPipe {
+			b.Error("Page %v: %v write error - %v", token, c.name, err)
+		}
+		pw.CloseWithError(err)
+	}()
+	return &compressReader{PipeReader: pr, done: done}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestStreamPageVerifiesChecksum(t *testing.T) {
+	config := newTestCacheConfig(t, cacheOptions{})
+	opener := config.store.(pageFileOpener)
+
+	c, err := codecByName("none")
+	if err != nil {
+		t.Fatalf("codecByName(none) - %v", err)
+	}
+
+	m := &writeHandler{baseHandler: baseHandler{config: config, requestID: "test"}}
+	info := &datasetInfo{Hash: strings.Repeat("a", 64), Tokens: []string{NewUUID()}}
+	if err := m.createDataset(info, 0, 0); err != nil {
+		t.Fatalf("createDataset - %v", err)
+	}
+
+	// The page is larger than the first block, so that it is streamed in parts
+	data := []byte(`{"rows":["` + strings.Repeat("x", 2*streamFirstBlock) + `"]}`)
+	page := &pageInfo{hash: info.Hash, token: info.Tokens[0], types: []string{pageContentType}, codec: c}
+	if _, err := m.writePage(data, page); err != nil {
+		t.Fatalf("writePage - %v", err)
+	}
+
+	read := func() ([]byte, error) {
+		body, err := m.streamPage(opener, page)
+		if err != nil {
+			t.Fatalf("streamPage - %v", err)
+		}
+		defer body.Close()
+		return ioutil.ReadAll(body)
+	}
+
+	got, err := read()
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("streamed %v bytes - %v, expected the page", len(got), err)
+	}
+
+	// Corrupt a byte near the end of the page, after the first block
+	f, offset, length, err := opener.OpenPage(info.Hash, m.getPageKey(page))
+	if err != nil {
+		t.Fatalf("OpenPage - %v", err)
+	}
+	name := f.Name()
+	f.Close()
+
+	w, err := os.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile - %v", err)
+	}
+	_, err = w.WriteAt([]byte{'y'}, offset+length-3)
+	w.Close()
+	if err != nil {
+		t.Fatalf("WriteAt - %v", err)
+	}
+
+	if _, err := read(); err != errEnvelopeCorrupt {
+		t.Fatalf("reading corrupt page returned %v, expected errEnvelopeCorrupt", err)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// pageJob is a page to be written by a pageWriter, with its position in the dataset
+type pageJob struct {
+	seq       int
+	token     string
+	nextToken string
+	records   [][]string
+	// nextOffset is the offset in the source of the first record of the next page
+	nextOffset int64
+}
+
+// pageWriter writes the pages of an ingest using a bounded number of workers.
+// Submitting a page blocks whilst the workers are busy and the queue is full,
+// holding back the reader of the source, so that only a bounded number of pages
+// are in memory at once.  Pages complete out of order, but the writer tracks the
+// contiguous prefix of pages, from the first, that have all been written.
+type pageWriter struct {
+	m     *writeHandler
+	ctx   context.Context
+	hash  string
+	cols  []Column
+	queue chan *pageJob
+	wg    sync.WaitGroup
+
+	// checkpoint, if set, is called with the last page of the contiguous prefix
+	// each time the prefix advances
+	checkpoint func(last *pageJob, ready int)
+
+	lock      sync.Mutex
+	written   map[int]*pageJob
+	ready     int
+	lastReady string
+	err       error
+}
+
+// newPageWriter starts a pageWriter with the number of workers, which stops
+// writing pages once ctx is cancelled.  first is the position of the first page
+// to be submitted, being non-zero when an ingest is resumed.
+func newPageWriter(ctx context.Context, m *writeHandler, hash string, cols []Column, workers, first int) *pageWriter {
+	if workers < 1 {
+		workers = 1
+	}
+
+	w := &pageWriter{
+		m:       m,
+		ctx:     ctx,
+		hash:    hash,
+		cols:    cols,
+		queue:   make(chan *pageJob, workers),
+		written: map[int]*pageJob{},
+		ready:   first,
+	}
+
+	for i := 0; i < workers; i++ {
+		w.wg.Add(1)
+		go w.work()
+	}
+	return w
+}
+
+// work writes pages from the queue until it is closed
+func (w *pageWriter) work() {
+	defer w.wg.Done()
+
+	for p := range w.queue {
+		err := w.m.createPage(w.ctx, w.hash, p.token, p.nextToken, w.cols, p.records)
+		w.complete(p, err)
+	}
+}
+
+// complete records the outcome of writing the page, advancing the contiguous prefix
+func (w *pageWriter) complete(p *pageJob, err error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if err != nil {
+		if w.err == nil {
+			w.err = err
+		}
+		return
+	}
+
+	// The records are no longer needed once written
+	p.records = nil
+	w.written[p.seq] = p
+
+	var last *pageJob
+	for {
+		next, ok := w.written[w.ready]
+		if !ok {
+			break
+		}
+		delete(w.written, w.ready)
+		w.ready++
+		w.lastReady = next.token
+		last = next
+	}
+
+	if last != nil && w.checkpoint != nil {
+		w.checkpoint(last, w.ready)
+	}
+	if w.m.job != nil {
+		w.m.job.pagesReady(w.ready)
+	}
+}
+
+// submit queues the page to be written, blocking whilst the queue is full.
+// The first error from writing pages is returned, after which no more pages
+// should be submitted.
+func (w *pageWriter) submit(p *pageJob) error {
+	if err := w.failed(); err != nil {
+		return err
+	}
+
+	select {
+	case w.queue <- p:
+		return nil
+	case <-w.ctx.Done():
+		return w.ctx.Err()
+	}
+}
+
+// failed returns the first error from writing pages
+func (w *pageWriter) failed() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.err
+}
+
+// contiguous returns the number of pages, from the first, that have all been
+// written, and the token of the last of these
+func (w *pageWriter) contiguous() (int, string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.ready, w.lastReady
+}
+
+// close waits for the queued pages to be written, returning the first error
+func (w *pageWriter) close() error {
+	close(w.queue)
+	w.wg.Wait()
+	return w.failed()
+}
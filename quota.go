@@ -0,0 +1,260 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gford1000-go/logger"
+)
+
+const (
+	// evictLRU evicts the least recently read datasets first
+	evictLRU = "lru"
+	// evictLFU evicts the least frequently read datasets first
+	evictLFU = "lfu"
+	// evictOldest evicts the earliest created datasets first
+	evictOldest = "oldest"
+)
+
+// errQuotaExceeded is returned when an ingest cannot be accommodated within the quota
+var errQuotaExceeded = errors.New("insufficient cache storage for request")
+
+// datasetUsage records the storage consumed by, and activity of, a dataset
+type datasetUsage struct {
+	bytes    int64
+	reserved int64
+	created  time.Time
+	lastRead time.Time
+	reads    uint64
+}
+
+// size returns the storage attributed to the dataset, which includes any
+// outstanding reservation for an ingest in progress
+func (u *datasetUsage) size() int64 {
+	if u.reserved > u.bytes {
+		return u.reserved
+	}
+	return u.bytes
+}
+
+// quotaManager limits the total storage used by datasets, evicting datasets
+// according to the policy when space is required for a new ingest
+type quotaManager struct {
+	registry *datasetRegistry
+	limit    int64
+	policy   string
+
+	// reserving is held throughout a reservation, so that concurrent reservations
+	// cannot each claim the same space whilst lock is released to evict datasets
+	reserving sync.Mutex
+
+	lock   sync.Mutex
+	usage  map[string]*datasetUsage
+	loaded bool
+}
+
+// newQuotaManager returns a quotaManager for the datasets of the registry.
+// A limit of zero or less means that storage is not limited.
+func newQuotaManager(registry *datasetRegistry, limit int64, policy string) (*quotaManager, error) {
+	policy = strings.ToLower(policy)
+	if policy != evictLRU && policy != evictLFU && policy != evictOldest {
+		return nil, fmt.Errorf("unsupported eviction policy: %v", policy)
+	}
+
+	q := &quotaManager{
+		registry: registry,
+		limit:    limit,
+		policy:   policy,
+		usage:    map[string]*datasetUsage{},
+	}
+	registry.notifyRemove(q.forget)
+	return q, nil
+}
+
+// load establishes the usage of existing datasets from their metadata; the caller must hold the lock
+func (q *quotaManager) load() {
+	if q.loaded {
+		return
+	}
+	q.loaded = true
+
+	hashes, err := q.registry.store.Datasets()
+	if err != nil {
+		logger.GetLogger()(logger.Error, "", "Error listing datasets for quota - %v", err)
+		return
+	}
+	for _, hash := range hashes {
+		if _, ok := q.usage[hash]; ok {
+			continue
+		}
+		info, err := q.registry.get(hash)
+		if err != nil || info == nil {
+			continue
+		}
+		q.usage[hash] = &datasetUsage{bytes: info.Bytes, created: info.Created, lastRead: info.Created}
+	}
+}
+
+// entry returns the usage of the dataset, creating it if required; the caller must hold the lock
+func (q *quotaManager) entry(hash string) *datasetUsage {
+	u, ok := q.usage[hash]
+	if !ok {
+		now := time.Now()
+		u = &datasetUsage{created: now, lastRead: now}
+		q.usage[hash] = u
+	}
+	return u
+}
+
+// total returns the storage used by all datasets; the caller must hold the lock
+func (q *quotaManager) total() int64 {
+	var total int64
+	for _, u := range q.usage {
+		total += u.size()
+	}
+	return total
+}
+
+// reserve ensures that the estimated bytes for the new dataset fit within the quota,
+// evicting other datasets if necessary.  errQuotaExceeded is returned, without any
+// datasets being evicted, if sufficient space cannot be made.  Should an eviction
+// fail, errQuotaExceeded is also returned, but datasets already evicted remain so.
+func (q *quotaManager) reserve(hash string, estimate int64) error {
+	q.reserving.Lock()
+	defer q.reserving.Unlock()
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.load()
+
+	if q.limit <= 0 {
+		q.entry(hash).reserved = estimate
+		return nil
+	}
+
+	// Usage is checked again after evicting, as it may have changed whilst unlocked
+	for {
+		var current int64
+		if u, ok := q.usage[hash]; ok {
+			current = u.size()
+		}
+
+		required := q.total() - current + estimate - q.limit
+		if required <= 0 {
+			q.entry(hash).reserved = estimate
+			return nil
+		}
+
+		victims := []string{}
+		for _, candidate := range q.candidates(hash) {
+			if required <= 0 {
+				break
+			}
+			victims = append(victims, candidate)
+			required -= q.usage[candidate].size()
+		}
+		if required > 0 {
+			return errQuotaExceeded
+		}
+
+		for _, victim := range victims {
+			// Release the lock whilst the store is updated, as removal calls back to forget
+			q.lock.Unlock()
+			freed, err := q.registry.remove(victim)
+			q.lock.Lock()
+			if err != nil {
+				logger.GetLogger()(logger.Error, "", "Error evicting dataset %v - %v", victim, err)
+				return errQuotaExceeded
+			}
+			logger.GetLogger()(logger.Info, "", "Evicted dataset %v, freeing %v bytes", victim, freed)
+		}
+	}
+}
+
+// candidates returns the datasets that may be evicted, in eviction order;
+// the caller must hold the lock
+func (q *quotaManager) candidates(exclude string) []string {
+	hashes := []string{}
+	for hash, u := range q.usage {
+		// Datasets with reservations are being ingested, so are not evicted
+		if hash != exclude && u.reserved == 0 {
+			hashes = append(hashes, hash)
+		}
+	}
+
+	sort.Slice(hashes, func(i, j int) bool {
+		a, b := q.usage[hashes[i]], q.usage[hashes[j]]
+		switch q.policy {
+		case evictLFU:
+			if a.reads != b.reads {
+				return a.reads < b.reads
+			}
+			return a.lastRead.Before(b.lastRead)
+		case evictOldest:
+			return a.created.Before(b.created)
+		default:
+			return a.lastRead.Before(b.lastRead)
+		}
+	})
+	return hashes
+}
+
+// release ends the reservation of an ingest, returning the bytes written
+func (q *quotaManager) release(hash string) int64 {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	u := q.entry(hash)
+	u.reserved = 0
+	return u.bytes
+}
+
+// record adds the bytes written for a page to the usage of the dataset
+func (q *quotaManager) record(hash string, bytes int64) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.entry(hash).bytes += bytes
+}
+
+// touch records a read of the dataset
+func (q *quotaManager) touch(hash string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if u, ok := q.usage[hash]; ok {
+		u.lastRead = time.Now()
+		u.reads++
+	}
+}
+
+// forget discards the usage of a dataset that has been removed
+func (q *quotaManager) forget(hash string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	delete(q.usage, hash)
+}
+
+// Stats returns a snapshot of the storage usage
+func (q *quotaManager) Stats() interface{} {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return struct {
+		Limit    int64  `json:"limit"`
+		Used     int64  `json:"used"`
+		Datasets int    `json:"datasets"`
+		Policy   string `json:"policy"`
+	}{
+		Limit:    q.limit,
+		Used:     q.total(),
+		Datasets: len(q.usage),
+		Policy:   q.policy,
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowStore is a PageStore whose datasets take time to delete, widening the
+// window in which the quota is unlocked during eviction
+type slowStore struct {
+	PageStore
+}
+
+func (s *slowStore) DeleteDataset(hash string) (int64, error) {
+	time.Sleep(10 * time.Millisecond)
+	return s.PageStore.DeleteDataset(hash)
+}
+
+func TestQuotaConcurrentReservations(t *testing.T) {
+	registry := newDatasetRegistry(&slowStore{PageStore: newMemoryStore(1 << 20)})
+	q, err := newQuotaManager(registry, 100, evictOldest)
+	if err != nil {
+		t.Fatalf("newQuotaManager - %v", err)
+	}
+
+	// Two existing datasets fill the quota, so every reservation must evict
+	for _, hash := range []string{"old1", "old2"} {
+		if err := registry.save(&datasetInfo{Hash: hash, Bytes: 50}); err != nil {
+			t.Fatalf("save - %v", err)
+		}
+		q.reserve(hash, 50)
+		q.record(hash, 50)
+		q.release(hash)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			q.reserve(fmt.Sprintf("new%v", i), 40)
+		}(i)
+	}
+	wg.Wait()
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if total := q.total(); total > q.limit {
+		t.Fatalf("reservations total %v bytes, exceeding the limit of %v", total, q.limit)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"crypto/cipher"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gford1000-go/logger"
+)
+
+// reencryptBatchBytes limits the bytes of pages saved in a single batch by the re-encryption job
+const reencryptBatchBytes = 32 << 20
+
+// errJobRunning is returned when a job is started whilst it is already running
+var errJobRunning = errors.New("job is already running")
+
+// reencryptStatus reports the progress of a re-encryption job
+type reencryptStatus struct {
+	State        string    `json:"state"`
+	KeyID        string    `json:"key_id"`
+	Started      time.Time `json:"started"`
+	Completed    time.Time `json:"completed"`
+	Datasets     int       `json:"datasets"`
+	DatasetsDone int       `json:"datasets_done"`
+	Pages        int64     `json:"pages"`
+	Reencrypted  int64     `json:"reencrypted"`
+	Failed       int64     `json:"failed"`
+	DataKeys     int64     `json:"data_keys"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// reencryptJob re-encrypts the pages of all datasets that are sealed with a
+// key other than the active key, so that retired keys can be removed, or that
+// were written in an earlier envelope version, so that they are bound to
+// their location by pageAAD.  The data keys of datasets are re-wrapped by
+// the KeyManager, if there is one.
+type reencryptJob struct {
+	config *cacheConfig
+	lock   sync.Mutex
+	status reencryptStatus
+}
+
+// newReencryptJob returns an idle job for the cache
+func newReencryptJob(config *cacheConfig) *reencryptJob {
+	return &reencryptJob{
+		config: config,
+		status: reencryptStatus{State: jobIdle},
+	}
+}
+
+// start begins the job in the background, using the currently active key
+func (j *reencryptJob) start() error {
+	keyID, block := j.config.keys.activeKey()
+	if block == nil && j.config.dataKeys == nil {
+		return errKeyNotFound
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if j.status.State == jobRunning {
+		return errJobRunning
+	}
+	j.status = reencryptStatus{
+		State:   jobRunning,
+		KeyID:   keyID,
+		Started: time.Now().UTC(),
+	}
+
+	go j.run(keyID)
+	return nil
+}
+
+// Status returns a snapshot of the progress of the job
+func (j *reencryptJob) Status() reencryptStatus {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	return j.status
+}
+
+// update applies f to the status whilst locked
+func (j *reencryptJob) update(f func(s *reencryptStatus)) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	f(&j.status)
+}
+
+// run re-encrypts each dataset in turn
+func (j *reencryptJob) run(keyID string) {
+	log := logger.GetLogger()
+
+	hashes, err := j.config.store.Datasets()
+	if err != nil {
+		log(logger.Error, "", "Re-encryption failed listing datasets - %v", err)
+		j.update(func(s *reencryptStatus) {
+			s.State = jobFailed
+			s.Error = err.Error()
+			s.Completed = time.Now().UTC()
+		})
+		return
+	}
+
+	j.update(func(s *reencryptStatus) { s.Datasets = len(hashes) })
+
+	for _, hash := range hashes {
+		if j.config.dataKeys != nil {
+			rewrapped, err := j.config.dataKeys.rewrap(hash)
+			if err != nil {
+				log(logger.Error, "", "Re-wrapping data key failed for dataset %v - %v", hash, err)
+				j.update(func(s *reencryptStatus) { s.Error = err.Error() })
+			} else if rewrapped {
+				j.update(func(s *reencryptStatus) { s.DataKeys++ })
+			}
+		}
+		if err := j.reencryptDataset(hash, keyID); err != nil {
+			log(logger.Error, "", "Re-encryption failed for dataset %v - %v", hash, err)
+			j.update(func(s *reencryptStatus) { s.Error = err.Error() })
+		}
+		j.update(func(s *reencryptStatus) { s.DatasetsDone++ })
+	}
+
+	j.update(func(s *reencryptStatus) {
+		s.State = jobComplete
+		if s.Error != "" {
+			s.State = jobFailed
+		}
+		s.Completed = time.Now().UTC()
+		log(logger.Info, "", "Re-encryption %v: %v of %v pages re-encrypted under key %v", s.State, s.Reencrypted, s.Pages, keyID)
+	})
+}
+
+// reencryptDataset re-encrypts the pages of the dataset that are not sealed by the key.
+// Pages are replaced in batches, atomically if the store supports it.  The dataset is
+// held throughout, so that it cannot be removed whilst its pages are replaced, and
+// datasets already removed are skipped rather than having pages written again.
+func (j *reencryptJob) reencryptDataset(hash, keyID string) error {
+	unlock := j.config.datasets.readLock(hash)
+	defer unlock()
+
+	info, err := j.config.datasets.get(hash)
+	if err != nil || info == nil {
+		return err
+	}
+
+	keys, err := j.config.store.List(hash)
+	if err != nil {
+		return err
+	}
+
+	batch := map[string][]byte{}
+	batchBytes := 0
+	failed := false
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := putPages(j.config.store, hash, batch); err != nil {
+			return err
+		}
+		n := int64(len(batch))
+		j.update(func(s *reencryptStatus) { s.Reencrypted += n })
+		batch = map[string][]byte{}
+		batchBytes = 0
+		return nil
+	}
+
+	for _, key := range keys {
+		if key == datasetKey || key == checkpointKey {
+			continue
+		}
+		j.update(func(s *reencryptStatus) { s.Pages++ })
+
+		data, err := j.reencryptPage(hash, key, keyID)
+		if err != nil {
+			failed = true
+			j.update(func(s *reencryptStatus) { s.Failed++ })
+			logger.GetLogger()(logger.Error, "", "Re-encryption failed for page %v/%v - %v", hash, key, err)
+			continue
+		}
+		if data == nil {
+			continue
+		}
+
+		batch[key] = data
+		batchBytes += len(data)
+		if batchBytes >= reencryptBatchBytes {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := flush(); err != nil {
+		return err
+	}
+	if failed {
+		return nil
+	}
+	return j.recordKey(hash, keyID)
+}
+
+// recordKey updates the metadata of the dataset with the key now sealing its pages,
+// unless these are sealed by its data key
+func (j *reencryptJob) recordKey(hash, keyID string) error {
+	if keyID == "" {
+		return nil
+	}
+	_, err := j.config.datasets.update(hash, func(info *datasetInfo) bool {
+		if info.DataKey != nil || info.KeyID == keyID {
+			return false
+		}
+		info.KeyID = keyID
+		return true
+	})
+	return err
+}
+
+// reencryptPage returns the page re-encrypted in the current envelope version, sealed
+// by the key if it is sealed by a keyring key, or by its data key otherwise.  nil is
+// returned if the page is not encrypted, or needs no change.
+func (j *reencryptJob) reencryptPage(hash, key, keyID string) ([]byte, error) {
+	raw, err := j.config.store.Get(hash, key)
+	if err != nil {
+		return nil, err
+	}
+
+	env, payload, err := j.config.readEnvelope(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	updated := *env
+	updated.version = envelopeVersion
+
+	var old, block cipher.Block
+	switch env.encryption {
+	case encryptionAESGCM:
+		if keyID != "" {
+			updated.keyID = keyID
+		}
+		if env.version == envelopeVersion && env.keyID == updated.keyID {
+			return nil, nil
+		}
+		if old, err = j.config.keys.key(env.keyID); err != nil {
+			return nil, err
+		}
+		if block, err = j.config.keys.key(updated.keyID); err != nil {
+			return nil, err
+		}
+	case encryptionDataKey:
+		if env.version == envelopeVersion {
+			return nil, nil
+		}
+		if j.config.dataKeys == nil {
+			return nil, errDataKeyUnavailable
+		}
+		if block, err = j.config.dataKeys.block(hash); err != nil {
+			return nil, err
+		}
+		old = block
+	default:
+		return nil, nil
+	}
+
+	plain, err := unseal(old, payload, pageAAD(env, hash, key))
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := seal(block, plain, pageAAD(&updated, hash, key))
+	if err != nil {
+		return nil, err
+	}
+	return updated.encode(sealed), nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// ReencryptRequest optionally changes the active key before re-encryption starts,
+// after reloading the keyring file if Reload is true
+type ReencryptRequest struct {
+	Active string `json:"active"`
+	Reload bool   `json:"reload"`
+}
+
+// NewReencryptRequestHandlerFactory returns a factory instance that manufactures Handlers
+// which start the re-encryption of the cache under the active key.
+func NewReencryptRequestHandlerFactory() HandlerFactory {
+	return &reencryptRequestHandlerFactory{}
+}
+
+type reencryptRequestHandlerFactory struct {
+}
+
+func (f *reencryptRequestHandlerFactory) New(pattern string, config *cacheConfig, requestID string) Handler {
+	h := &reencryptRequestHandler{}
+	h.method = http.MethodPost
+	h.config = config
+	h.handler = h.handleStart
+	h.pattern = pattern
+	h.requestID = requestID
+
+	return h
+}
+
+// NewReencryptStatusHandlerFactory returns a factory instance that manufactures Handlers
+// which report the progress of re-encryption.
+func NewReencryptStatusHandlerFactory() HandlerFactory {
+	return &reencryptStatusHandlerFactory{}
+}
+
+type reencryptStatusHandlerFactory struct {
+}
+
+func (f *reencryptStatusHandlerFactory) New(pattern string, config *cacheConfig, requestID string) Handler {
+	h := &reencryptRequestHandler{}
+	h.method = http.MethodGet
+	h.config = config
+	h.handler = h.handleStatus
+	h.pattern = pattern
+	h.requestID = requestID
+
+	return h
+}
+
+type reencryptRequestHandler struct {
+	baseHandler
+}
+
+// handleStart is invoked after the initial authorization and validation checks are completed,
+// and starts the re-encryption job
+func (r *reencryptRequestHandler) handleStart(w http.ResponseWriter, req *http.Request) {
+
+	var p ReencryptRequest
+	if req.ContentLength != 0 {
+		if err := json.NewDecoder(req.Body).Decode(&p); err != nil {
+			returnError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if p.Reload {
+		if r.config.keysFile == "" {
+			returnError(w, "no keyring file is configured", http.StatusBadRequest)
+			return
+		}
+		if err := r.config.keys.load(r.config.keysFile); err != nil {
+			r.Error("Error reloading keyring - %v", err)
+			returnError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if p.Active != "" {
+		if err := r.config.keys.setActive(p.Active); err != nil {
+			returnError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.Info("Active key changed to %v", p.Active)
+	}
+
+	if err := r.config.reencrypt.start(); err != nil {
+		returnError(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(r.config.reencrypt.Status())
+}
+
+// handleStatus is invoked after the initial authorization and validation checks are completed,
+// and returns the progress of the re-encryption job
+func (r *reencryptRequestHandler) handleStatus(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(r.config.reencrypt.Status())
+}
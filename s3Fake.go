@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// s3Fake is an in-process stand-in for an S3 compatible service, supporting
+// the subset of the API used by s3Store, and verifying request signatures
+type s3Fake struct {
+	config  s3Config
+	lock    sync.RWMutex
+	objects map[string][]byte
+}
+
+// startS3Fake starts an s3Fake listening on a local port, returning its endpoint
+func startS3Fake(config s3Config) (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+
+	f := &s3Fake{config: config, objects: map[string][]byte{}}
+	go http.Serve(l, f)
+
+	return fmt.Sprintf("http://%v", l.Addr()), nil
+}
+
+func (f *s3Fake) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !f.authorized(req) {
+		f.error(w, "SignatureDoesNotMatch", http.StatusForbidden)
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/"), "/", 2)
+	if parts[0] != f.config.bucket {
+		f.error(w, "NoSuchBucket", http.StatusNotFound)
+		return
+	}
+
+	if len(parts) == 1 || parts[1] == "" {
+		if req.Method == http.MethodGet {
+			f.list(w, req)
+			return
+		}
+		f.error(w, "MethodNotAllowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	key := parts[1]
+	switch req.Method {
+	case http.MethodPut:
+		data, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			f.error(w, "IncompleteBody", http.StatusBadRequest)
+			return
+		}
+		f.lock.Lock()
+		f.objects[key] = data
+		f.lock.Unlock()
+		w.WriteHeader(http.StatusOK)
+	case http.MethodGet:
+		f.lock.RLock()
+		data, ok := f.objects[key]
+		f.lock.RUnlock()
+		if !ok {
+			f.error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+	case http.MethodDelete:
+		f.lock.Lock()
+		delete(f.objects, key)
+		f.lock.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.error(w, "MethodNotAllowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// authorized verifies the Signature V4 of the request
+func (f *s3Fake) authorized(req *http.Request) bool {
+	auth := req.Header.Get("Authorization")
+	amzDate := req.Header.Get("x-amz-date")
+	if len(amzDate) < 8 {
+		return false
+	}
+	if _, err := time.Parse("20060102T150405Z", amzDate); err != nil {
+		return false
+	}
+
+	signature := s3Signature(req, f.config.secretKey, f.config.region, amzDate, amzDate[:8])
+	expected := fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%v/%v/%v/s3/aws4_request, SignedHeaders=%v, Signature=%v",
+		f.config.accessKey, amzDate[:8], f.config.region, s3SignedHeaders, signature)
+	return auth == expected
+}
+
+// list implements ListObjectsV2, with prefix, delimiter and continuation support
+func (f *s3Fake) list(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+	after := query.Get("continuation-token")
+
+	maxKeys := 1000
+	if n, err := strconv.Atoi(query.Get("max-keys")); err == nil && n > 0 {
+		maxKeys = n
+	}
+
+	f.lock.RLock()
+	keys := []string{}
+	sizes := map[string]int64{}
+	for key, data := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+			sizes[key] = int64(len(data))
+		}
+	}
+	f.lock.RUnlock()
+	sort.Strings(keys)
+
+	result := s3ListResult{}
+	seenPrefixes := map[string]bool{}
+	count := 0
+	for _, key := range keys {
+		if key <= after {
+			continue
+		}
+
+		// Keys within a common prefix already returned are passed over, even once
+		// the page is full, so that the prefix is not repeated by the next page
+		p := ""
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				p = key[:len(prefix)+i+len(delimiter)]
+			}
+		}
+		if p != "" && seenPrefixes[p] {
+			result.NextContinuationToken = key
+			continue
+		}
+
+		if count == maxKeys {
+			result.IsTruncated = true
+			break
+		}
+		if p != "" {
+			seenPrefixes[p] = true
+			result.CommonPrefixes = append(result.CommonPrefixes, struct {
+				Prefix string `xml:"Prefix"`
+			}{Prefix: p})
+			result.NextContinuationToken = key
+			count++
+			continue
+		}
+		result.Contents = append(result.Contents, struct {
+			Key  string `xml:"Key"`
+			Size int64  `xml:"Size"`
+		}{Key: key, Size: sizes[key]})
+		result.NextContinuationToken = key
+		count++
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	xml.NewEncoder(w).Encode(result)
+}
+
+// error returns an S3 style error response
+func (f *s3Fake) error(w http.ResponseWriter, code string, status int) {
+	type s3ErrorResponse struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string   `xml:"Code"`
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(s3ErrorResponse{Code: code})
+}
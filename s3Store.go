@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3Config specifies the S3 compatible bucket used by an s3Store
+type s3Config struct {
+	endpoint  string
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	// prefix, if present, is prepended to the names of all objects
+	prefix string
+	// maxKeys, if positive, limits the objects returned by each listing request
+	maxKeys int
+}
+
+// s3Store is a PageStore that holds each page as an object named <hash>/<key>,
+// optionally within a prefix, in an S3 compatible bucket, using path style addressing and AWS Signature V4
+type s3Store struct {
+	config s3Config
+	client *http.Client
+}
+
+// newS3Store returns an s3Store for the configured bucket
+func newS3Store(config s3Config) (*s3Store, error) {
+	if config.endpoint == "" || config.bucket == "" {
+		return nil, fmt.Errorf("s3 store requires an endpoint and bucket")
+	}
+	if config.region == "" {
+		config.region = "us-east-1"
+	}
+	config.endpoint = strings.TrimRight(config.endpoint, "/")
+
+	return &s3Store{
+		config: config,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// object returns the name of the object holding the page
+func (s *s3Store) object(hash, key string) string {
+	return s.datasetPrefix(hash) + key
+}
+
+// datasetPrefix returns the prefix of the names of the objects of the dataset
+func (s *s3Store) datasetPrefix(hash string) string {
+	return s.rootPrefix() + hash + "/"
+}
+
+// rootPrefix returns the prefix of the names of all objects
+func (s *s3Store) rootPrefix() string {
+	if s.config.prefix == "" {
+		return ""
+	}
+	return strings.Trim(s.config.prefix, "/") + "/"
+}
+
+// s3ListResult is the response of a ListObjectsV2 request
+type s3ListResult struct {
+	XMLName  xml.Name `xml:"ListBucketResult"`
+	Contents []struct {
+		Key  string `xml:"Key"`
+		Size int64  `xml:"Size"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *s3Store) Put(hash, key string, data []byte) error {
+	if err := validateHash(hash); err != nil {
+		return err
+	}
+	resp, err := s.do(http.MethodPut, s.object(hash, key), nil, data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return s3Error(resp, http.StatusOK)
+}
+
+func (s *s3Store) Get(hash, key string) ([]byte, error) {
+	if err := validateHash(hash); err != nil {
+		return nil, err
+	}
+	resp, err := s.do(http.MethodGet, s.object(hash, key), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errPageNotFound
+	}
+	if err := s3Error(resp, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (s *s3Store) Delete(hash, key string) error {
+	if err := validateHash(hash); err != nil {
+		return err
+	}
+	resp, err := s.do(http.MethodDelete, s.object(hash, key), nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	return s3Error(resp, http.StatusNoContent, http.StatusOK)
+}
+
+func (s *s3Store) List(hash string) ([]string, error) {
+	if err := validateHash(hash); err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	prefix := s.datasetPrefix(hash)
+	err := s.list(prefix, "", func(r *s3ListResult) {
+		for _, c := range r.Contents {
+			keys = append(keys, strings.TrimPrefix(c.Key, prefix))
+		}
+	})
+	return keys, err
+}
+
+func (s *s3Store) Datasets() ([]string, error) {
+	hashes := []string{}
+	root := s.rootPrefix()
+	err := s.list(root, "/", func(r *s3ListResult) {
+		for _, p := range r.CommonPrefixes {
+			hashes = append(hashes, strings.TrimSuffix(strings.TrimPrefix(p.Prefix, root), "/"))
+		}
+	})
+	return hashes, err
+}
+
+func (s *s3Store) DeleteDataset(hash string) (int64, error) {
+	if err := validateHash(hash); err != nil {
+		return 0, err
+	}
+	prefix := s.datasetPrefix(hash)
+	objects := map[string]int64{}
+	err := s.list(prefix, "", func(r *s3ListResult) {
+		for _, c := range r.Contents {
+			objects[strings.TrimPrefix(c.Key, prefix)] = c.Size
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var freed int64
+	for key, size := range objects {
+		if err := s.Delete(hash, key); err != nil {
+			return freed, err
+		}
+		freed += size
+	}
+	return freed, nil
+}
+
+// list pages through the results of ListObjectsV2 for the prefix
+func (s *s3Store) list(prefix, delimiter string, f func(r *s3ListResult)) error {
+	token := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		if delimiter != "" {
+			query.Set("delimiter", delimiter)
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		if s.config.maxKeys > 0 {
+			query.Set("max-keys", strconv.Itoa(s.config.maxKeys))
+		}
+
+		resp, err := s.do(http.MethodGet, "", query, nil)
+		if err != nil {
+			return err
+		}
+
+		var result s3ListResult
+		err = s3Error(resp, http.StatusOK)
+		if err == nil {
+			err = xml.NewDecoder(resp.Body).Decode(&result)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		f(&result)
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// do sends a signed request for the object (or the bucket, if object is empty)
+func (s *s3Store) do(method, object string, query url.Values, body []byte) (*http.Response, error) {
+	path := "/" + s.config.bucket
+	if object != "" {
+		path += "/" + object
+	}
+
+	rawQuery := s3CanonicalQuery(query)
+	target := s.config.endpoint + s3EncodePath(path)
+	if rawQuery != "" {
+		target += "?" + rawQuery
+	}
+
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	s3Sign(req, s.config, body, time.Now().UTC())
+	return s.client.Do(req)
+}
+
+// s3Error returns an error describing the response, unless it has one of the expected status codes
+func s3Error(resp *http.Response, expected ...int) error {
+	for _, code := range expected {
+		if resp.StatusCode == code {
+			return nil
+		}
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("s3 request failed with status %v: %s", resp.StatusCode, msg)
+}
+
+// s3Sign adds the AWS Signature V4 headers to the request
+func s3Sign(req *http.Request, config s3Config, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	payloadHash := sha256.Sum256(body)
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", hex.EncodeToString(payloadHash[:]))
+
+	scope := fmt.Sprintf("%v/%v/s3/aws4_request", date, config.region)
+	signature := s3Signature(req, config.secretKey, config.region, amzDate, date)
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v",
+		config.accessKey, scope, s3SignedHeaders, signature))
+}
+
+// s3SignedHeaders lists the headers included in the signature
+const s3SignedHeaders = "host;x-amz-content-sha256;x-amz-date"
+
+// s3Signature calculates the signature of the request, which must already have
+// its x-amz-date and x-amz-content-sha256 headers set
+func s3Signature(req *http.Request, secretKey, region, amzDate, date string) string {
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EncodePath(req.URL.Path),
+		s3CanonicalQuery(req.URL.Query()),
+		"host:" + req.Host + "\n" +
+			"x-amz-content-sha256:" + req.Header.Get("x-amz-content-sha256") + "\n" +
+			"x-amz-date:" + amzDate + "\n",
+		s3SignedHeaders,
+		req.Header.Get("x-amz-content-sha256"),
+	}, "\n")
+
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := fmt.Sprintf("%v/%v/s3/aws4_request", date, region)
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	mac := func(key []byte, data string) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(data))
+		return h.Sum(nil)
+	}
+
+	signingKey := mac(mac(mac(mac([]byte("AWS4"+secretKey), date), region), "s3"), "aws4_request")
+	return hex.EncodeToString(mac(signingKey, stringToSign))
+}
+
+// s3CanonicalQuery returns the query string with sorted, encoded parameters
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := []string{}
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Encode(k, true)+"="+s3Encode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3EncodePath encodes each segment of the path
+func s3EncodePath(path string) string {
+	return s3Encode(path, false)
+}
+
+// s3Encode applies the URI encoding required by Signature V4
+func s3Encode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"testing"
+)
+
+// newFakeS3Store returns an s3Store using a newly started s3Fake
+func newFakeS3Store(t *testing.T, config s3Config) *s3Store {
+	t.Helper()
+
+	config.bucket = "dataproxy"
+	config.accessKey = "access"
+	config.secretKey = "secret"
+	config.region = "us-east-1"
+
+	endpoint, err := startS3Fake(config)
+	if err != nil {
+		t.Fatalf("Error starting fake - %v", err)
+	}
+	config.endpoint = endpoint
+
+	s, err := newS3Store(config)
+	if err != nil {
+		t.Fatalf("Error creating store - %v", err)
+	}
+	return s
+}
+
+func TestS3StorePutGetDelete(t *testing.T) {
+	s := newFakeS3Store(t, s3Config{})
+
+	data := []byte("page data")
+	if err := s.Put("h1", "k1", data); err != nil {
+		t.Fatalf("Put - %v", err)
+	}
+
+	got, err := s.Get("h1", "k1")
+	if err != nil {
+		t.Fatalf("Get - %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("Get returned %q, expected %q", got, data)
+	}
+
+	if err := s.Delete("h1", "k1"); err != nil {
+		t.Fatalf("Delete - %v", err)
+	}
+	if _, err := s.Get("h1", "k1"); err != errPageNotFound {
+		t.Fatalf("Get after Delete returned %v, expected errPageNotFound", err)
+	}
+
+	// Deleting a missing page is not an error
+	if err := s.Delete("h1", "k1"); err != nil {
+		t.Fatalf("Delete of missing page - %v", err)
+	}
+}
+
+func TestS3StoreRejectsInvalidHash(t *testing.T) {
+	s := newFakeS3Store(t, s3Config{})
+
+	if err := s.Put("../h1", "k1", []byte("x")); err == nil {
+		t.Fatal("Put with invalid hash succeeded")
+	}
+}
+
+func TestS3StoreRejectsBadCredentials(t *testing.T) {
+	s := newFakeS3Store(t, s3Config{})
+	s.config.secretKey = "wrong"
+
+	if err := s.Put("h1", "k1", []byte("x")); err == nil {
+		t.Fatal("Put with the wrong secret key succeeded")
+	}
+}
+
+func TestS3StoreListAndDatasets(t *testing.T) {
+	// A small page size makes every listing span several requests
+	for _, prefix := range []string{"", "tenant"} {
+		t.Run(fmt.Sprintf("prefix=%q", prefix), func(t *testing.T) {
+			s := newFakeS3Store(t, s3Config{prefix: prefix, maxKeys: 2})
+
+			hashes := []string{"h1", "h2", "h3", "h4", "h5"}
+			keys := []string{"k1", "k2", "k3"}
+			for _, hash := range hashes {
+				for _, key := range keys {
+					if err := s.Put(hash, key, []byte(hash+key)); err != nil {
+						t.Fatalf("Put - %v", err)
+					}
+				}
+			}
+
+			got, err := s.Datasets()
+			if err != nil {
+				t.Fatalf("Datasets - %v", err)
+			}
+			sort.Strings(got)
+			if fmt.Sprint(got) != fmt.Sprint(hashes) {
+				t.Fatalf("Datasets returned %v, expected %v", got, hashes)
+			}
+
+			got, err = s.List("h3")
+			if err != nil {
+				t.Fatalf("List - %v", err)
+			}
+			sort.Strings(got)
+			if fmt.Sprint(got) != fmt.Sprint(keys) {
+				t.Fatalf("List returned %v, expected %v", got, keys)
+			}
+		})
+	}
+}
+
+func TestS3StoreDeleteDataset(t *testing.T) {
+	s := newFakeS3Store(t, s3Config{maxKeys: 2})
+
+	var expected int64
+	for _, key := range []string{"k1", "k2", "k3"} {
+		data := []byte("data of " + key)
+		expected += int64(len(data))
+		if err := s.Put("h1", key, data); err != nil {
+			t.Fatalf("Put - %v", err)
+		}
+	}
+	if err := s.Put("h2", "k1", []byte("kept")); err != nil {
+		t.Fatalf("Put - %v", err)
+	}
+
+	freed, err := s.DeleteDataset("h1")
+	if err != nil {
+		t.Fatalf("DeleteDataset - %v", err)
+	}
+	if freed != expected {
+		t.Fatalf("DeleteDataset freed %v bytes, expected %v", freed, expected)
+	}
+
+	got, err := s.Datasets()
+	if err != nil {
+		t.Fatalf("Datasets - %v", err)
+	}
+	if fmt.Sprint(got) != "[h2]" {
+		t.Fatalf("Datasets after DeleteDataset returned %v, expected [h2]", got)
+	}
+	if _, err := s.Get("h2", "k1"); err != nil {
+		t.Fatalf("Get of other dataset - %v", err)
+	}
+}
@@ -1,12 +1,186 @@
 package main
 
-import "crypto/cipher"
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/gford1000-go/logger"
+)
 
 type cacheConfig struct {
-	root           string
-	salt           []byte
-	cipher         cipher.Block
-	useCompression bool
+	root             string
+	salt             []byte
+	keys             *keyring
+	keysFile         string
+	reencrypt        *reencryptJob
+	dataKeys         *dataKeys
+	useCompression   bool
+	codec            *codec
+	compressionLevel int
+	transcode        bool
+	streamPages      bool
+	store            PageStore
+	datasets         *datasetRegistry
+	quota            *quotaManager
+	defaultTTL       time.Duration
+	ingests          *flightGroup
+	ingestWorkers    int
+	jobs             *jobRegistry
+	tenant           string
+	tenants          *tenantRegistry
+	// allTenants is set for admin tenants, whose requests may address other tenants
+	allTenants *tenantRegistry
+}
+
+// cacheOptions specifies how a cacheConfig is created
+type cacheOptions struct {
+	storeKind        string
+	store            storeOptions
+	salt             string
+	key              string
+	keysFile         string
+	useCompression   bool
+	codec            string
+	compressionLevel int
+	transcode        bool
+	streamPages      bool
+	ingestWorkers    int
+	defaultTTL       time.Duration
+	gcInterval       time.Duration
+	quota            int64
+	evictPolicy      string
+	kms              string
+	kmsURL           string
+	kmsStandIn       bool
+	packConvert      bool
+	packCompact      bool
+}
+
+// newCacheConfig creates the page store, keys and dataset management of a
+// cache, performs any startup maintenance of the store, and starts the sweeper
+func newCacheConfig(opts *cacheOptions) (*cacheConfig, error) {
+	if err := os.MkdirAll(opts.store.root, 0744); err != nil {
+		return nil, err
+	}
+
+	// -zip implies lz4, which was the only codec before the codec was configurable
+	codecName := opts.codec
+	if codecName == "" && opts.useCompression {
+		codecName = "lz4"
+	}
+	codec, err := codecByName(codecName)
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := newPageStore(opts.storeKind, &opts.store)
+	if err != nil {
+		return nil, fmt.Errorf("error creating page store - %v", err)
+	}
+
+	c := &cacheConfig{
+		root:             opts.store.root,
+		salt:             []byte(opts.salt),
+		useCompression:   opts.useCompression,
+		codec:            codec,
+		compressionLevel: opts.compressionLevel,
+		transcode:        opts.transcode,
+		streamPages:      opts.streamPages,
+		defaultTTL:       opts.defaultTTL,
+		ingests:          newFlightGroup(),
+		ingestWorkers:    opts.ingestWorkers,
+		jobs:             newJobRegistry(),
+		store:            store,
+		datasets:         newDatasetRegistry(store),
+		keys:             newKeyring(),
+		keysFile:         opts.keysFile,
+	}
+
+	c.quota, err = newQuotaManager(c.datasets, opts.quota, opts.evictPolicy)
+	if err != nil {
+		return nil, fmt.Errorf("error creating quota - %v", err)
+	}
+
+	if key := []byte(opts.key); len(key) > 0 {
+		if err := c.keys.add(legacyKeyID, key); err != nil {
+			return nil, fmt.Errorf("error creating cipher - %v", err)
+		}
+	}
+	if opts.keysFile != "" {
+		if err := c.keys.load(opts.keysFile); err != nil {
+			return nil, fmt.Errorf("error loading keys - %v", err)
+		}
+	}
+	c.reencrypt = newReencryptJob(c)
+
+	if opts.kms != "" {
+		url := opts.kmsURL
+		if opts.kmsStandIn {
+			url, err = startKMSStandIn(&localKeyManager{keys: c.keys})
+			if err != nil {
+				return nil, fmt.Errorf("error starting key manager stand-in - %v", err)
+			}
+		}
+		km, err := newKeyManager(opts.kms, url, c.keys)
+		if err != nil {
+			return nil, fmt.Errorf("error creating key manager - %v", err)
+		}
+		c.dataKeys = newDataKeys(km, c.datasets)
+	}
+
+	if err := c.maintainStore(opts); err != nil {
+		return nil, err
+	}
+
+	// Ingests interrupted when the process last stopped are resumed
+	c.resumeIngests()
+
+	c.datasets.startSweeper(opts.gcInterval)
+
+	return c, nil
+}
+
+// maintainStore tidies the page store before any requests are processed
+func (c *cacheConfig) maintainStore(opts *cacheOptions) error {
+	log := logger.GetLogger()
+
+	if r, ok := c.store.(tempFileRemover); ok {
+		n, err := r.RemoveTempFiles()
+		if err != nil {
+			return fmt.Errorf("error removing temporary files - %v", err)
+		}
+		log(logger.Info, "", "Removed %v orphaned temporary files from %v", n, c.root)
+	}
+
+	if p, ok := c.store.(*packStore); ok {
+		if opts.packConvert {
+			n, err := p.ConvertFileDatasets()
+			if err != nil {
+				return fmt.Errorf("error converting datasets - %v", err)
+			}
+			log(logger.Info, "", "Converted %v pages in %v to pack format", n, c.root)
+		}
+		if opts.packCompact {
+			n, err := p.CompactAll()
+			if err != nil {
+				return fmt.Errorf("error compacting datasets - %v", err)
+			}
+			log(logger.Info, "", "Compaction of %v reclaimed %v bytes", c.root, n)
+		}
+	}
+	return nil
+}
+
+// close releases the resources of the page store, if it has any
+func (c *cacheConfig) close() {
+	if c.store == nil {
+		return
+	}
+	if closer, ok := c.store.(io.Closer); ok {
+		closer.Close()
+	}
 }
 
 type serverConfig struct {
@@ -14,3 +188,27 @@ type serverConfig struct {
 	log   string
 	cache *cacheConfig
 }
+
+// legacyEnvelope describes pages written without an envelope, which were
+// encoded according to the configuration of the server
+func (c *cacheConfig) legacyEnvelope() *pageEnvelope {
+	env := &pageEnvelope{contentType: pageContentType}
+	if c.useCompression {
+		env.codec = codecLZ4
+	}
+	if _, err := c.keys.key(legacyKeyID); err == nil {
+		env.encryption = encryptionAESGCM
+		env.keyID = legacyKeyID
+	}
+	return env
+}
+
+// readEnvelope returns the envelope and payload of a stored page, describing
+// pages written without an envelope using legacyEnvelope
+func (c *cacheConfig) readEnvelope(raw []byte) (*pageEnvelope, []byte, error) {
+	env, payload, err := decodeEnvelope(raw)
+	if err == errNoEnvelope {
+		return c.legacyEnvelope(), raw, nil
+	}
+	return env, payload, err
+}
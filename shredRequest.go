@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// ShredRequest identifies the dataset whose data key is to be destroyed
+type ShredRequest struct {
+	RequestHash string `json:"hash"`
+}
+
+// NewShredRequestHandlerFactory returns a factory instance that manufactures Handlers
+// which crypto-shred a dataset by destroying its data key.
+func NewShredRequestHandlerFactory() HandlerFactory {
+	return &shredRequestHandlerFactory{}
+}
+
+type shredRequestHandlerFactory struct {
+}
+
+func (f *shredRequestHandlerFactory) New(pattern string, config *cacheConfig, requestID string) Handler {
+	h := &shredRequestHandler{}
+	h.method = http.MethodPost
+	h.config = config
+	h.handler = h.handleShred
+	h.pattern = pattern
+	h.requestID = requestID
+
+	return h
+}
+
+type shredRequestHandler struct {
+	baseHandler
+}
+
+// handleShred is invoked after the initial authorization and validation checks are completed,
+// and destroys the data key of the dataset, leaving its pages unreadable
+func (s *shredRequestHandler) handleShred(w http.ResponseWriter, req *http.Request) {
+
+	if s.config.dataKeys == nil {
+		returnError(w, "no key manager is configured", http.StatusBadRequest)
+		return
+	}
+
+	var p ShredRequest
+	if err := json.NewDecoder(req.Body).Decode(&p); err != nil {
+		returnError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.config.dataKeys.destroy(p.RequestHash); err != nil {
+		s.Error("Error destroying data key of %v - %v", p.RequestHash, err)
+		returnError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.Info("Destroyed data key of %v", p.RequestHash)
+
+	w.WriteHeader(http.StatusNoContent)
+}
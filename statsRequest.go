@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// statsReporter is implemented by PageStores that can report usage statistics
+type statsReporter interface {
+	Stats() interface{}
+}
+
+// NewStatsRequestHandlerFactory returns a factory instance that manufactures Handlers
+// which report the usage statistics of the page store.
+func NewStatsRequestHandlerFactory() HandlerFactory {
+	return &statsRequestHandlerFactory{}
+}
+
+type statsRequestHandlerFactory struct {
+}
+
+func (f *statsRequestHandlerFactory) New(pattern string, config *cacheConfig, requestID string) Handler {
+	h := &statsRequestHandler{}
+	h.method = http.MethodGet
+	h.config = config
+	h.handler = h.handleStats
+	h.pattern = pattern
+	h.requestID = requestID
+
+	return h
+}
+
+type statsRequestHandler struct {
+	baseHandler
+}
+
+// handleStats is invoked after the initial authorization and validation checks are completed,
+// and returns the statistics of the page store, if it provides them, and of the datasets
+func (s *statsRequestHandler) handleStats(w http.ResponseWriter, req *http.Request) {
+
+	stats := map[string]interface{}{
+		"datasets": s.config.datasets.Stats(),
+		"quota":    s.config.quota.Stats(),
+	}
+	if r, ok := s.config.store.(statsReporter); ok {
+		stats["store"] = r.Stats()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(stats)
+}
@@ -2,6 +2,8 @@ package main
 
 import (
     "net/http"
+	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -28,3 +30,53 @@ func getRequestSupportedTypes(req *http.Request) ([]string, []string) {
 
 	return requestedTypes, getSupportedContentTypes()
 }
+
+// getRequestEncodings examines the Accept-Encoding headers to determine the
+// content-codings that the client is prepared to process, in order of
+// preference.  Codings with a quality of zero, and identity, are excluded,
+// and are instead returned as refused, so that "*" is not taken to mean them.
+func getRequestEncodings(req *http.Request) ([]string, map[string]bool) {
+	type encoding struct {
+		name    string
+		quality float64
+	}
+
+	encodings := []encoding{}
+	refused := map[string]bool{}
+	for _, h := range req.Header.Values("Accept-Encoding") {
+		for _, e := range strings.Split(h, ",") {
+			params := strings.Split(e, ";")
+			name := strings.ToLower(strings.TrimSpace(params[0]))
+			if name == "" || name == "identity" {
+				continue
+			}
+
+			quality := 1.0
+			for _, param := range params[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					q, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+					if err == nil {
+						quality = q
+					}
+				}
+			}
+			if quality <= 0 {
+				refused[name] = true
+				continue
+			}
+
+			encodings = append(encodings, encoding{name: name, quality: quality})
+		}
+	}
+
+	sort.SliceStable(encodings, func(i, j int) bool {
+		return encodings[i].quality > encodings[j].quality
+	})
+
+	names := []string{}
+	for _, e := range encodings {
+		names = append(names, e.name)
+	}
+	return names, refused
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestAcceptedCodecHonoursRefusedCodings(t *testing.T) {
+	tests := map[string]string{
+		"gzip":                  "gzip",
+		"zstd, gzip;q=0.5":      "zstd",
+		"*":                     "gzip",
+		"gzip;q=0, *":           "zstd",
+		"gzip;q=0, zstd;q=0, *": "<nil>",
+		"identity":              "<nil>",
+		"br":                    "<nil>",
+	}
+
+	for header, expected := range tests {
+		req, _ := http.NewRequest(http.MethodGet, "/page", nil)
+		req.Header.Set("Accept-Encoding", header)
+
+		encodings, refused := getRequestEncodings(req)
+		info := &pageInfo{encodings: encodings, refused: refused}
+
+		name := "<nil>"
+		if c := info.acceptedCodec(); c != nil {
+			name = c.encoding
+		}
+		if name != expected {
+			t.Errorf("Accept-Encoding %q selected %v, expected %v", header, name, expected)
+		}
+		if header == "gzip;q=0, *" && info.accepts(codecs[codecGzip]) {
+			t.Errorf("Accept-Encoding %q accepts gzip", header)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// errUnknownTenant is returned when a request does not carry the credentials of a tenant
+var errUnknownTenant = errors.New("unknown or missing credentials")
+
+// tenantDefinition is the format of each entry in the tenants file.  Tenants do not
+// share the key, salt, cache folder or quota of other tenants, or of the server flags.
+type tenantDefinition struct {
+	ID        string `json:"id"`
+	APIKey    string `json:"api_key"`
+	Key       string `json:"key"`
+	KeysFile  string `json:"keys_file"`
+	Salt      string `json:"salt"`
+	Directory string `json:"directory"`
+	Quota     int64  `json:"quota"`
+	// Admin tenants may list and delete the datasets of all tenants
+	Admin bool `json:"admin"`
+}
+
+// tenant is a client of the server, with its own isolated cache
+type tenant struct {
+	id     string
+	apiKey [sha256.Size]byte
+	config *cacheConfig
+}
+
+// tenantRegistry resolves the tenant of each request from its credentials
+type tenantRegistry struct {
+	tenants []*tenant
+}
+
+// loadTenants creates the cache of each tenant defined in the file.  The tenant's
+// cache is held in its own folder (or object prefix) within that of the server,
+// with other options taken from base.  No two tenants may share a folder.
+func loadTenants(fileName string, base *cacheOptions) (*tenantRegistry, error) {
+	b, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	var defs []tenantDefinition
+	if err := json.Unmarshal(b, &defs); err != nil {
+		return nil, err
+	}
+
+	r := &tenantRegistry{}
+	seen := map[string]bool{}
+	dirs := map[string]string{}
+	for _, def := range defs {
+		if def.ID == "" || def.APIKey == "" {
+			return nil, fmt.Errorf("tenants require an id and api_key")
+		}
+		if seen[def.ID] {
+			return nil, fmt.Errorf("tenant %v is defined more than once", def.ID)
+		}
+		seen[def.ID] = true
+
+		dir := def.Directory
+		if dir == "" {
+			dir = def.ID
+		}
+		if err := validateHash(dir); err != nil || dir == "." {
+			return nil, fmt.Errorf("tenant %v has an invalid directory", def.ID)
+		}
+
+		// Tenants sharing a directory would share datasets, so each must have its own,
+		// compared without case as some filesystems are case insensitive
+		if other, ok := dirs[strings.ToLower(dir)]; ok {
+			return nil, fmt.Errorf("tenants %v and %v have the same directory", other, def.ID)
+		}
+		dirs[strings.ToLower(dir)] = def.ID
+
+		opts := *base
+		opts.store.root = fmt.Sprintf("%v/%v", base.store.root, dir)
+		opts.store.s3.prefix = dir
+		opts.salt = def.Salt
+		opts.key = def.Key
+		opts.keysFile = def.KeysFile
+		opts.quota = def.Quota
+
+		config, err := newCacheConfig(&opts)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %v - %v", def.ID, err)
+		}
+		config.tenant = def.ID
+		if def.Admin {
+			config.allTenants = r
+		}
+
+		r.tenants = append(r.tenants, &tenant{
+			id:     def.ID,
+			apiKey: sha256.Sum256([]byte(def.APIKey)),
+			config: config,
+		})
+	}
+
+	return r, nil
+}
+
+// resolve returns the cache of the tenant whose API key is presented by the request,
+// either as a bearer token or in the X-API-Key header
+func (r *tenantRegistry) resolve(req *http.Request) (*cacheConfig, error) {
+	key := req.Header.Get("X-API-Key")
+	if auth := req.Header.Get("Authorization"); key == "" && strings.HasPrefix(auth, "Bearer ") {
+		key = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if key == "" {
+		return nil, errUnknownTenant
+	}
+
+	// Compare against every tenant, in constant time, so that timing does not reveal keys
+	presented := sha256.Sum256([]byte(key))
+	var found *tenant
+	for _, t := range r.tenants {
+		if subtle.ConstantTimeCompare(presented[:], t.apiKey[:]) == 1 {
+			found = t
+		}
+	}
+	if found == nil {
+		return nil, errUnknownTenant
+	}
+	return found.config, nil
+}
+
+// cache returns the cache of the tenant, or nil if there is no such tenant
+func (r *tenantRegistry) cache(id string) *cacheConfig {
+	for _, t := range r.tenants {
+		if t.id == id {
+			return t.config
+		}
+	}
+	return nil
+}
+
+// caches returns the cache of each tenant
+func (r *tenantRegistry) caches() []*cacheConfig {
+	caches := make([]*cacheConfig, 0, len(r.tenants))
+	for _, t := range r.tenants {
+		caches = append(caches, t.config)
+	}
+	return caches
+}
+
+// close releases the resources of each tenant's cache
+func (r *tenantRegistry) close() {
+	for _, t := range r.tenants {
+		t.config.close()
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadTenantsRejectsSharedDirectories(t *testing.T) {
+	tests := map[string]string{
+		"duplicate": `[{"id": "a", "api_key": "ka", "directory": "shared"}, {"id": "b", "api_key": "kb", "directory": "shared"}]`,
+		"default":   `[{"id": "a", "api_key": "ka"}, {"id": "b", "api_key": "kb", "directory": "a"}]`,
+		"case":      `[{"id": "a", "api_key": "ka", "directory": "Shared"}, {"id": "b", "api_key": "kb", "directory": "shared"}]`,
+		"root":      `[{"id": "a", "api_key": "ka", "directory": "."}]`,
+		"nested":    `[{"id": "a", "api_key": "ka", "directory": "b/a"}]`,
+	}
+
+	for name, defs := range tests {
+		t.Run(name, func(t *testing.T) {
+			root := t.TempDir()
+			fileName := filepath.Join(root, "tenants.json")
+			if err := ioutil.WriteFile(fileName, []byte(defs), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			r, err := loadTenants(fileName, &cacheOptions{
+				storeKind:   "file",
+				store:       storeOptions{root: root},
+				evictPolicy: evictLRU,
+				gcInterval:  time.Hour,
+			})
+			if err == nil {
+				for _, c := range r.caches() {
+					c.close()
+				}
+				t.Fatal("tenants were loaded")
+			}
+			if !strings.Contains(err.Error(), "directory") {
+				t.Fatalf("unexpected error - %v", err)
+			}
+		})
+	}
+}
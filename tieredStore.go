@@ -0,0 +1,375 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gford1000-go/logger"
+)
+
+const (
+	// writeThrough saves pages to both tiers before Put returns
+	writeThrough = "writethrough"
+	// writeBack saves pages to memory, with the disk tier updated in the background
+	writeBack = "writeback"
+)
+
+// maxPromotionCandidates bounds the number of pages whose disk hits are counted
+const maxPromotionCandidates = 100000
+
+// writeBackRetry is the interval between attempts to write back pages whose write failed
+const writeBackRetry = time.Second
+
+// tieredStats reports the usage of a tieredStore
+type tieredStats struct {
+	Policy     string      `json:"policy"`
+	Promotions uint64      `json:"promotions"`
+	DiskHits   uint64      `json:"disk_hits"`
+	Pending    int         `json:"pending"`
+	Failed     int         `json:"failed"`
+	Memory     interface{} `json:"memory"`
+}
+
+// tieredStore is a PageStore that holds recently used pages in memory, in front
+// of a durable store.  Pages read from the durable store are promoted into memory
+// once they have been read promoteAfter times.
+type tieredStore struct {
+	memory       *memoryStore
+	disk         PageStore
+	policy       string
+	promoteAfter int
+
+	lock       sync.Mutex
+	diskHits   map[string]int
+	pending    map[string]*memoryPage
+	failed     int
+	done       chan struct{}
+	promotions uint64
+	hitCount   uint64
+
+	// writeLock is held whilst a page is written back, and whilst pages are deleted,
+	// so that a page is never written back to disk after it has been deleted
+	writeLock sync.Mutex
+
+	// queueLock is held shared to send to the queue, and exclusively to close it
+	queueLock sync.RWMutex
+	queue     chan *memoryPage
+	closed    bool
+}
+
+// newTieredStore returns a tieredStore using the specified policy
+func newTieredStore(memory *memoryStore, disk PageStore, policy string, promoteAfter int) (*tieredStore, error) {
+	policy = strings.ToLower(policy)
+	if policy != writeThrough && policy != writeBack {
+		return nil, fmt.Errorf("unsupported tier policy: %v", policy)
+	}
+	if promoteAfter < 1 {
+		promoteAfter = 1
+	}
+
+	t := &tieredStore{
+		memory:       memory,
+		disk:         disk,
+		policy:       policy,
+		promoteAfter: promoteAfter,
+		diskHits:     map[string]int{},
+		pending:      map[string]*memoryPage{},
+		queue:        make(chan *memoryPage, 1024),
+		done:         make(chan struct{}),
+	}
+
+	if policy == writeBack {
+		go t.flush()
+	} else {
+		close(t.done)
+	}
+
+	return t, nil
+}
+
+// tierKey combines hash and key into a single map key
+func tierKey(hash, key string) string {
+	return hash + "/" + key
+}
+
+func (t *tieredStore) Put(hash, key string, data []byte) error {
+	if t.policy == writeThrough {
+		if err := t.disk.Put(hash, key, data); err != nil {
+			return err
+		}
+		// A page too large for memory is still durable, so not an error
+		t.memory.Put(hash, key, data)
+		return nil
+	}
+
+	// Write back needs the page held in memory until it reaches disk,
+	// so pages that are too large are written synchronously
+	if err := t.memory.Put(hash, key, data); err != nil {
+		return t.disk.Put(hash, key, data)
+	}
+
+	// Once closed, pages are no longer written back
+	t.queueLock.RLock()
+	defer t.queueLock.RUnlock()
+	if t.closed {
+		return t.disk.Put(hash, key, data)
+	}
+
+	page := &memoryPage{hash: hash, key: key, data: append([]byte{}, data...)}
+
+	t.lock.Lock()
+	t.pending[tierKey(hash, key)] = page
+	t.lock.Unlock()
+
+	t.queue <- page
+	return nil
+}
+
+func (t *tieredStore) Get(hash, key string) ([]byte, error) {
+	if data, err := t.memory.Get(hash, key); err == nil {
+		return data, nil
+	}
+
+	k := tierKey(hash, key)
+
+	t.lock.Lock()
+	if page, ok := t.pending[k]; ok {
+		t.lock.Unlock()
+		return page.data, nil
+	}
+	t.lock.Unlock()
+
+	data, err := t.disk.Get(hash, key)
+	if err != nil {
+		return nil, err
+	}
+
+	t.lock.Lock()
+	t.hitCount++
+	if len(t.diskHits) >= maxPromotionCandidates {
+		t.diskHits = map[string]int{}
+	}
+	t.diskHits[k]++
+	promote := t.diskHits[k] >= t.promoteAfter
+	if promote {
+		delete(t.diskHits, k)
+		t.promotions++
+	}
+	t.lock.Unlock()
+
+	if promote {
+		t.memory.Put(hash, key, data)
+	}
+
+	return data, nil
+}
+
+func (t *tieredStore) Delete(hash, key string) error {
+	k := tierKey(hash, key)
+
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+
+	t.lock.Lock()
+	delete(t.pending, k)
+	delete(t.diskHits, k)
+	t.lock.Unlock()
+
+	t.memory.Delete(hash, key)
+	return t.disk.Delete(hash, key)
+}
+
+func (t *tieredStore) List(hash string) ([]string, error) {
+	keys, err := t.disk.List(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	for _, key := range keys {
+		seen[key] = true
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for _, page := range t.pending {
+		if page.hash == hash && !seen[page.key] {
+			keys = append(keys, page.key)
+		}
+	}
+	return keys, nil
+}
+
+func (t *tieredStore) Datasets() ([]string, error) {
+	hashes, err := t.disk.Datasets()
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	for _, hash := range hashes {
+		seen[hash] = true
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for _, page := range t.pending {
+		if !seen[page.hash] {
+			seen[page.hash] = true
+			hashes = append(hashes, page.hash)
+		}
+	}
+	return hashes, nil
+}
+
+func (t *tieredStore) DeleteDataset(hash string) (int64, error) {
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+
+	t.lock.Lock()
+	for k, page := range t.pending {
+		if page.hash == hash {
+			delete(t.pending, k)
+		}
+	}
+	for k := range t.diskHits {
+		if strings.HasPrefix(k, tierKey(hash, "")) {
+			delete(t.diskHits, k)
+		}
+	}
+	t.lock.Unlock()
+
+	t.memory.DeleteDataset(hash)
+	return t.disk.DeleteDataset(hash)
+}
+
+// RemoveTempFiles deletes temporary files left behind by the disk tier, if it uses them
+func (t *tieredStore) RemoveTempFiles() (int, error) {
+	if r, ok := t.disk.(tempFileRemover); ok {
+		return r.RemoveTempFiles()
+	}
+	return 0, nil
+}
+
+// Stats returns a snapshot of the usage of the store
+func (t *tieredStore) Stats() interface{} {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return tieredStats{
+		Policy:     t.policy,
+		Promotions: t.promotions,
+		DiskHits:   t.hitCount,
+		Pending:    len(t.pending),
+		Failed:     t.failed,
+		Memory:     t.memory.Stats(),
+	}
+}
+
+// Close waits for any pending pages to be written to disk, returning an error if
+// some could not be written
+func (t *tieredStore) Close() error {
+	if t.policy != writeBack {
+		return nil
+	}
+
+	t.queueLock.Lock()
+	if !t.closed {
+		t.closed = true
+		close(t.queue)
+	}
+	t.queueLock.Unlock()
+	<-t.done
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.failed > 0 {
+		return fmt.Errorf("%v pages could not be written back to disk", t.failed)
+	}
+	return nil
+}
+
+// flush writes queued pages to disk, for the write back policy.  Pages whose
+// write fails remain pending, and so readable, and are retried periodically
+// and once more when the store is closed.
+func (t *tieredStore) flush() {
+	defer close(t.done)
+
+	retry := time.NewTicker(writeBackRetry)
+	defer retry.Stop()
+
+	failed := []*memoryPage{}
+	for {
+		select {
+		case page, ok := <-t.queue:
+			if !ok {
+				t.retry(failed)
+				return
+			}
+			if !t.writeBack(page) {
+				failed = append(failed, page)
+				t.setFailed(len(failed))
+			}
+		case <-retry.C:
+			failed = t.retry(failed)
+		}
+	}
+}
+
+// retry writes back the pages whose write failed, returning those that fail again
+func (t *tieredStore) retry(pages []*memoryPage) []*memoryPage {
+	if len(pages) == 0 {
+		return pages
+	}
+
+	failed := []*memoryPage{}
+	for _, page := range pages {
+		if !t.writeBack(page) {
+			failed = append(failed, page)
+		}
+	}
+	t.setFailed(len(failed))
+	return failed
+}
+
+// setFailed records the number of pages whose write back has failed
+func (t *tieredStore) setFailed(n int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.failed = n
+}
+
+// writeBack writes the page to disk, unless it has since been deleted or replaced,
+// after which it is no longer pending.  false is returned if the write failed.
+func (t *tieredStore) writeBack(page *memoryPage) bool {
+	k := tierKey(page.hash, page.key)
+
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+
+	t.lock.Lock()
+	current, ok := t.pending[k]
+	t.lock.Unlock()
+
+	if !ok || current != page {
+		return true
+	}
+
+	if err := t.disk.Put(page.hash, page.key, page.data); err != nil {
+		logger.GetLogger()(logger.Error, "", "Error writing back page %v - %v", k, err)
+		return false
+	}
+
+	t.lock.Lock()
+	if t.pending[k] == page {
+		delete(t.pending, k)
+	}
+	t.lock.Unlock()
+	return true
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyStore is a PageStore whose Put fails the specified number of times
+type flakyStore struct {
+	PageStore
+	lock     sync.Mutex
+	failures int
+}
+
+func (f *flakyStore) Put(hash, key string, data []byte) error {
+	f.lock.Lock()
+	fail := f.failures > 0
+	if fail {
+		f.failures--
+	}
+	f.lock.Unlock()
+
+	if fail {
+		return errors.New("disk unavailable")
+	}
+	return f.PageStore.Put(hash, key, data)
+}
+
+func TestTieredStoreRetriesFailedWriteBack(t *testing.T) {
+	disk := &flakyStore{PageStore: newMemoryStore(1 << 20), failures: 1}
+	s, err := newTieredStore(newMemoryStore(1<<20), disk, writeBack, 1)
+	if err != nil {
+		t.Fatalf("Error creating store - %v", err)
+	}
+
+	if err := s.Put("h1", "k1", []byte("page")); err != nil {
+		t.Fatalf("Put - %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Stats().(tieredStats).Failed == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("write back did not fail")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The page remains readable whilst it is yet to reach disk, even once
+	// evicted from memory
+	s.memory.Delete("h1", "k1")
+	if data, err := s.Get("h1", "k1"); err != nil || string(data) != "page" {
+		t.Fatalf("Get of failed page returned %q - %v", data, err)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close - %v", err)
+	}
+	if data, err := disk.Get("h1", "k1"); err != nil || string(data) != "page" {
+		t.Fatalf("page was not written back, Get returned %q - %v", data, err)
+	}
+}
+
+func TestTieredStoreCloseReportsUnwrittenPages(t *testing.T) {
+	disk := &flakyStore{PageStore: newMemoryStore(1 << 20), failures: 1000}
+	s, err := newTieredStore(newMemoryStore(1<<20), disk, writeBack, 1)
+	if err != nil {
+		t.Fatalf("Error creating store - %v", err)
+	}
+
+	if err := s.Put("h1", "k1", []byte("page")); err != nil {
+		t.Fatalf("Put - %v", err)
+	}
+	if err := s.Close(); err == nil {
+		t.Fatal("Close succeeded with a page that could not be written")
+	}
+}
+
+func TestTieredStorePutDuringClose(t *testing.T) {
+	disk := newMemoryStore(1 << 20)
+	s, err := newTieredStore(newMemoryStore(1<<20), disk, writeBack, 1)
+	if err != nil {
+		t.Fatalf("Error creating store - %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				s.Put("h1", NewUUID(), []byte("page"))
+			}
+		}()
+	}
+	time.Sleep(time.Millisecond)
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close - %v", err)
+	}
+	wg.Wait()
+
+	// Every page reaches disk, whether written back or once the store is closed
+	keys, err := disk.List("h1")
+	if err != nil {
+		t.Fatalf("List - %v", err)
+	}
+	if len(keys) != 8*200 {
+		t.Fatalf("disk holds %v pages, expected %v", len(keys), 8*200)
+	}
+}
+
+// gatedStore is a PageStore whose Put signals entered, then waits for release
+type gatedStore struct {
+	PageStore
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (g *gatedStore) Put(hash, key string, data []byte) error {
+	g.entered <- struct{}{}
+	<-g.release
+	return g.PageStore.Put(hash, key, data)
+}
+
+func TestTieredStoreDeleteDuringWriteBack(t *testing.T) {
+	disk := &gatedStore{
+		PageStore: newMemoryStore(1 << 20),
+		entered:   make(chan struct{}, 1),
+		release:   make(chan struct{}),
+	}
+	s, err := newTieredStore(newMemoryStore(1<<20), disk, writeBack, 1)
+	if err != nil {
+		t.Fatalf("Error creating store - %v", err)
+	}
+
+	if err := s.Put("h1", "k1", []byte("page")); err != nil {
+		t.Fatalf("Put - %v", err)
+	}
+	<-disk.entered
+
+	// The dataset is deleted whilst its page is being written back
+	deleted := make(chan error)
+	go func() {
+		_, err := s.DeleteDataset("h1")
+		deleted <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(disk.release)
+
+	if err := <-deleted; err != nil {
+		t.Fatalf("DeleteDataset - %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close - %v", err)
+	}
+
+	if _, err := disk.Get("h1", "k1"); err != errPageNotFound {
+		t.Fatalf("Get after DeleteDataset returned %v, expected errPageNotFound", err)
+	}
+	if hashes, _ := disk.Datasets(); len(hashes) != 0 {
+		t.Fatalf("disk holds datasets %v after DeleteDataset", hashes)
+	}
+}
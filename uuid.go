@@ -4,8 +4,17 @@ import (
 	"github.com/google/uuid"
 )
 
+// requestNamespace is the namespace of UUIDs derived from requests
+var requestNamespace = uuid.MustParse("5c0c7a2e-4e0b-4c8e-9f0a-6d1f3b2a9c47")
+
 // NewUUID returns the string representation of a UUID
 func NewUUID() string {
 	v, _ := uuid.NewRandom()
 	return v.String()
-}
\ No newline at end of file
+}
+
+// NewHashUUID returns the string representation of a UUID derived from the data,
+// so that the same data always gives the same UUID
+func NewHashUUID(data []byte) string {
+	return uuid.NewSHA1(requestNamespace, data).String()
+}
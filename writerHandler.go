@@ -2,13 +2,135 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"time"
 )
 
 // writeHandler extends baseHandler to provide standard support for writing
 // pages to the cache
 type writeHandler struct {
 	baseHandler
+	codec *codec
+	// job, if set, records the progress of the ingest
+	job *ingestJob
+}
+
+// requestHash returns the hash of a dataset, derived from the canonical form of the
+// request that creates it, so that identical requests identify the same dataset
+func (m *writeHandler) requestHash(canonical interface{}) (string, error) {
+	b, err := json.Marshal(canonical)
+	if err != nil {
+		return "", err
+	}
+	return NewHashUUID(b), nil
+}
+
+// cachedDataset returns the metadata of the dataset if it has already been created
+// and remains available, so that it can be returned rather than created again.
+// Expired datasets, those without tokens to return, and those whose data key has
+// been destroyed, are removed so that they can be created afresh.  Callers coalesce
+// identical requests (see flightGroup), but ingests continue after the request that
+// started them, so errIngestRunning is returned rather than removing a dataset
+// whose ingest is still running.
+func (m *writeHandler) cachedDataset(hash string) (*datasetInfo, error) {
+	info, err := m.config.datasets.get(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.config.datasets.checkAvailable(hash)
+	if err != nil && err != errDatasetExpired {
+		return nil, err
+	}
+	shredded := info != nil && m.config.dataKeys != nil && len(info.DataKey) == 0
+	if err == nil && info != nil && len(info.Tokens) > 0 && !shredded {
+		return info, nil
+	}
+
+	if err == errDatasetExpired || info != nil {
+		m.Debug("Dataset %v is expired, incomplete or shredded, and is to be created again", hash)
+		if _, err := m.config.jobs.removeIdle(hash, m.config.datasets.remove); err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// discardDataset removes a dataset whose creation failed, so that an identical
+// request creates it again rather than returning an incomplete dataset
+func (m *writeHandler) discardDataset(hash string) {
+	if _, err := m.config.datasets.remove(hash); err != nil {
+		m.Error("Error discarding dataset %v - %v", hash, err)
+	}
+}
+
+// createDataset reserves storage for, and records the metadata of, a new dataset
+// which expires after ttlSeconds, or after the configured default if ttlSeconds
+// is not positive.  info describes the dataset, with the page tokens returned to
+// the request, which may be only the first.  errQuotaExceeded is returned if the
+// estimated bytes of the dataset cannot be accommodated.
+func (m *writeHandler) createDataset(info *datasetInfo, ttlSeconds int, estimate int64) error {
+	hash := info.Hash
+	if err := m.config.quota.reserve(hash, estimate); err != nil {
+		m.Error("Unable to reserve %v bytes for dataset %v - %v", estimate, hash, err)
+		return err
+	}
+
+	info.Created = time.Now().UTC()
+
+	// Pages are written with the requested codec, or else the configured codec
+	if c := m.codec; c != nil {
+		info.Codec = c.name
+	} else if c := m.config.codec; c != nil {
+		info.Codec = c.name
+	}
+
+	ttl := m.config.defaultTTL
+	if ttlSeconds > 0 {
+		ttl = time.Duration(ttlSeconds) * time.Second
+	}
+	if ttl > 0 {
+		info.Expires = info.Created.Add(ttl)
+	}
+
+	// Pages are encrypted with the dataset's data key, or else the active key
+	if m.config.dataKeys == nil {
+		info.KeyID, _ = m.config.keys.activeKey()
+	} else if err := m.config.dataKeys.create(info); err != nil {
+		m.Error("Error creating data key for dataset %v - %v", hash, err)
+		m.config.quota.release(hash)
+		return err
+	}
+
+	err := m.config.datasets.save(info)
+	if err != nil {
+		m.Error("Error saving dataset %v - %v", hash, err)
+		m.config.quota.release(hash)
+	}
+	return err
+}
+
+// completeDataset releases the storage reservation of the dataset, once all its
+// pages have been written, and records the bytes actually used and the rows,
+// together with the page tokens if these were not all known when the dataset
+// was created
+func (m *writeHandler) completeDataset(hash string, tokens []string, rows int64) error {
+	bytes := m.config.quota.release(hash)
+
+	saved, err := m.config.datasets.update(hash, func(info *datasetInfo) bool {
+		info.Bytes = bytes
+		info.Rows = rows
+		if tokens != nil {
+			info.Tokens = tokens
+		}
+		info.Pages = len(info.Tokens)
+		return true
+	})
+	if err != nil || !saved {
+		m.Error("Error completing dataset %v - %v", hash, err)
+	}
+	return err
 }
 
 // createPageBytes constructs the JSON page and returns as a byte array
@@ -62,20 +184,32 @@ func (m *writeHandler) createPageBytes(nextPageToken string, cols []Column, reco
 	return buf.Bytes()
 }
 
-// createPage creates a single page, generating the remaining records up to the page size
-func (m *writeHandler) createPage(hash, pageToken, nextPageToken string, cols []Column, records [][]string) error {
+// createPage creates a single page, generating the remaining records up to the page size.
+// The page is not created if ctx has been cancelled.
+func (m *writeHandler) createPage(ctx context.Context, hash, pageToken, nextPageToken string, cols []Column, records [][]string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
 	b := m.createPageBytes(nextPageToken, cols, records)
 
 	info := &pageInfo{
 		hash:  hash,
 		token: pageToken,
+		codec: m.codec,
 	}
 
-	err := m.writePage(b, info)
+	n, err := m.writePage(b, info)
 	if err != nil {
+		if m.job != nil {
+			m.job.fail(err)
+		}
 		return err
 	}
 
+	if m.job != nil {
+		m.job.pageWritten(n)
+		m.job.pageReady(pageToken)
+	}
 	return nil
 }
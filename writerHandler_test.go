@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCachedDatasetRecreatesShredded(t *testing.T) {
+	config := newTestCacheConfig(t, cacheOptions{key: "0123456789abcdef", kms: "local"})
+
+	m := &writeHandler{baseHandler: baseHandler{config: config, requestID: "test"}}
+	hash := "dataset"
+	if err := m.createDataset(&datasetInfo{Hash: hash, Tokens: []string{NewUUID()}}, 0, 0); err != nil {
+		t.Fatalf("createDataset - %v", err)
+	}
+
+	if info, err := m.cachedDataset(hash); err != nil || info == nil {
+		t.Fatalf("cachedDataset before shred returned %v - %v", info, err)
+	}
+
+	if err := config.dataKeys.destroy(hash); err != nil {
+		t.Fatalf("destroy - %v", err)
+	}
+	if info, err := m.cachedDataset(hash); err != nil || info != nil {
+		t.Fatalf("cachedDataset after shred returned %v - %v, expected none", info, err)
+	}
+	if info, _ := config.datasets.get(hash); info != nil {
+		t.Fatal("shredded dataset was not removed")
+	}
+}
+
+func TestCachedDatasetKeepsDatasetBeingIngested(t *testing.T) {
+	config := newTestCacheConfig(t, cacheOptions{})
+
+	m := &writeHandler{baseHandler: baseHandler{config: config, requestID: "test"}}
+	hash := "dataset"
+	if err := m.createDataset(&datasetInfo{Hash: hash, Tokens: []string{NewUUID()}}, 0, 0); err != nil {
+		t.Fatalf("createDataset - %v", err)
+	}
+	job := config.jobs.start(hash, "existing")
+
+	// The dataset has expired, but its ingest is still writing pages
+	config.datasets.update(hash, func(info *datasetInfo) bool {
+		info.Expires = time.Now().Add(-time.Second)
+		return true
+	})
+	if _, err := m.cachedDataset(hash); err != errIngestRunning {
+		t.Fatalf("cachedDataset returned %v, expected errIngestRunning", err)
+	}
+	if info, _ := config.datasets.get(hash); info == nil {
+		t.Fatal("dataset being ingested was removed")
+	}
+
+	job.finish()
+	if info, err := m.cachedDataset(hash); err != nil || info != nil {
+		t.Fatalf("cachedDataset after ingest returned %v - %v, expected none", info, err)
+	}
+}